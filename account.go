@@ -0,0 +1,178 @@
+package jt809server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/lai323/jt809server/jt809"
+)
+
+// 上级平台分配给下级平台的账号，GNSSCenterID 是下级平台接入码
+type Account struct {
+	Name         string   `json:"name"`
+	GNSSCenterID uint32   `json:"gnssCenterId"`
+	UserID       uint32   `json:"userId"`
+	Password     string   `json:"password"`
+	AllowedIPs   []string `json:"allowedIps"` // 允许登录的来源 IP 或者 CIDR，为空时不限制
+	Enabled      bool     `json:"enabled"`
+}
+
+func (a *Account) allowIP(ip net.IP) bool {
+	if len(a.AllowedIPs) == 0 {
+		return true
+	}
+	for _, allowed := range a.AllowedIPs {
+		if _, ipnet, err := net.ParseCIDR(allowed); err == nil {
+			if ipnet.Contains(ip) {
+				return true
+			}
+			continue
+		}
+		if allowedIP := net.ParseIP(allowed); allowedIP != nil && allowedIP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// 下级平台账号的存储
+type AccountStore interface {
+	// 按接入码查询账号，不存在时返回 nil, nil
+	Account(gnssCenterID uint32) (*Account, error)
+}
+
+// 使用 AccountStore 验证下级平台的登录请求
+func AccountAuthenticator(store AccountStore) Authenticator {
+	return AuthenticatorFunc(func(gnssCenterID uint32, req *jt809.UpConnectReq, remoteAddr net.Addr) byte {
+		a, err := store.Account(gnssCenterID)
+		if err != nil {
+			return jt809.UpConnectOther
+		}
+		if a == nil {
+			return jt809.UpConnectGNSSCenterIDError
+		}
+		if !a.Enabled || a.UserID != req.UserID {
+			return jt809.UpConnectUnregistered
+		}
+		if tcpAddr, ok := remoteAddr.(*net.TCPAddr); ok && !a.allowIP(tcpAddr.IP) {
+			return jt809.UpConnectIPError
+		}
+		// 固定时间比较，避免通过应答时间猜测密码
+		if subtle.ConstantTimeCompare(jt809.FixedLengthString(a.Password, 8, false), req.Password) != 1 {
+			return jt809.UpConnectPasswordError
+		}
+		return jt809.UpConnectSuccess
+	})
+}
+
+type MemoryAccountStore struct {
+	mtx      sync.RWMutex
+	accounts map[uint32]Account
+}
+
+func NewMemoryAccountStore(accounts ...Account) *MemoryAccountStore {
+	s := &MemoryAccountStore{accounts: map[uint32]Account{}}
+	for _, a := range accounts {
+		s.accounts[a.GNSSCenterID] = a
+	}
+	return s
+}
+
+func (s *MemoryAccountStore) Account(gnssCenterID uint32) (*Account, error) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	a, ok := s.accounts[gnssCenterID]
+	if !ok {
+		return nil, nil
+	}
+	return &a, nil
+}
+
+// 添加或者替换账号
+func (s *MemoryAccountStore) Put(a Account) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.accounts[a.GNSSCenterID] = a
+}
+
+func (s *MemoryAccountStore) Delete(gnssCenterID uint32) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	delete(s.accounts, gnssCenterID)
+}
+
+// 按接入码排序返回所有账号
+func (s *MemoryAccountStore) Accounts() []Account {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	ret := make([]Account, 0, len(s.accounts))
+	for _, a := range s.accounts {
+		ret = append(ret, a)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].GNSSCenterID < ret[j].GNSSCenterID })
+	return ret
+}
+
+func (s *MemoryAccountStore) replace(accounts []Account) {
+	m := make(map[uint32]Account, len(accounts))
+	for _, a := range accounts {
+		m[a.GNSSCenterID] = a
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.accounts = m
+}
+
+// 账号保存在 JSON 文件中，文件内容是 Account 数组
+// 修改文件后调用 Reload 重新加载，Put/Delete 之后调用 Save 写回文件
+type FileAccountStore struct {
+	*MemoryAccountStore
+	path string
+}
+
+func LoadFileAccountStore(path string) (*FileAccountStore, error) {
+	s := &FileAccountStore{MemoryAccountStore: NewMemoryAccountStore(), path: path}
+	err := s.Reload()
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// 重新加载账号文件，文件不存在时账号为空
+func (s *FileAccountStore) Reload() error {
+	b, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		s.replace(nil)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var accounts []Account
+	err = json.Unmarshal(b, &accounts)
+	if err != nil {
+		return err
+	}
+	s.replace(accounts)
+	return nil
+}
+
+// 先写入临时文件再重命名，避免写入过程中崩溃损坏账号文件
+func (s *FileAccountStore) Save() error {
+	b, err := json.MarshalIndent(s.Accounts(), "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	err = ioutil.WriteFile(tmp, b, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
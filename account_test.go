@@ -0,0 +1,83 @@
+package jt809server
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/lai323/jt809server/jt809"
+)
+
+func TestAccountAuthenticator(t *testing.T) {
+	store := NewMemoryAccountStore(
+		Account{GNSSCenterID: 1, UserID: 10, Password: "pass", Enabled: true, AllowedIPs: []string{"10.0.0.0/8", "192.168.1.1"}},
+		Account{GNSSCenterID: 2, UserID: 20, Password: "pass", Enabled: false},
+	)
+	auth := AccountAuthenticator(store)
+
+	newReq := func(userID uint32, password string) *jt809.UpConnectReq {
+		req := jt809.NewUpConnectReq()
+		req.UserID = userID
+		req.Password = jt809.FixedLengthString(password, 8, false)
+		return req
+	}
+	addr := func(ip string) net.Addr {
+		return &net.TCPAddr{IP: net.ParseIP(ip), Port: 809}
+	}
+
+	tests := []struct {
+		gnssCenterID uint32
+		req          *jt809.UpConnectReq
+		addr         net.Addr
+		result       byte
+	}{
+		{1, newReq(10, "pass"), addr("10.1.2.3"), jt809.UpConnectSuccess},
+		{1, newReq(10, "pass"), addr("192.168.1.1"), jt809.UpConnectSuccess},
+		{1, newReq(10, "pass"), addr("192.168.1.2"), jt809.UpConnectIPError},
+		{1, newReq(10, "wrong"), addr("10.1.2.3"), jt809.UpConnectPasswordError},
+		{1, newReq(11, "pass"), addr("10.1.2.3"), jt809.UpConnectUnregistered},
+		{2, newReq(20, "pass"), addr("10.1.2.3"), jt809.UpConnectUnregistered},
+		{3, newReq(10, "pass"), addr("10.1.2.3"), jt809.UpConnectGNSSCenterIDError},
+	}
+	for _, test := range tests {
+		result := auth.Authenticate(test.gnssCenterID, test.req, test.addr)
+		if result != test.result {
+			t.Error("Authenticate error", test.gnssCenterID, test.req, test.addr, result, test.result)
+		}
+	}
+}
+
+func TestFileAccountStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jt809account")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "accounts.json")
+
+	store, err := LoadFileAccountStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := Account{Name: "test", GNSSCenterID: 1, UserID: 10, Password: "pass", Enabled: true}
+	store.Put(a)
+	if err := store.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	store, err = LoadFileAccountStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := store.Account(1)
+	if err != nil || got == nil || !reflect.DeepEqual(*got, a) {
+		t.Error("FileAccountStore Account error", got, err)
+	}
+	got, err = store.Account(2)
+	if err != nil || got != nil {
+		t.Error("FileAccountStore Account should be nil", got, err)
+	}
+}
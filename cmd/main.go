@@ -1,12 +1,14 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"runtime/debug"
 	"syscall"
 	"time"
@@ -14,105 +16,163 @@ import (
 	"github.com/lai323/jt809server"
 	"github.com/lai323/jt809server/jt809"
 	"github.com/lai323/jt809server/log"
+	kitlog "github.com/go-kit/log"
 	"github.com/go-kit/log/level"
 )
 
-func waitInterrupt(srv *jt809server.Server) {
+func waitInterrupt(m *jt809server.Manager, logger kitlog.Logger) {
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
 	<-c
-	srv.Shutdown()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	err := m.Shutdown(ctx)
+	if err != nil {
+		level.Error(logger).Log("msg", "Shutdown", "error", err)
+	}
+}
+
+// 上级平台的连接信息
+type Upstream struct {
+	Name         string
+	UserID       uint32
+	Password     string
+	GNSSCenterID uint32
+	UpLinkIP     string
+	UpLinkPort   uint16
+	DownLinkIP   string
+	DownLinkPort uint16
 }
 
+var upstreams = []Upstream{
+	{
+		Name:         "province",
+		UserID:       1,
+		Password:     "1",
+		GNSSCenterID: 1,
+		UpLinkIP:     "localhost",
+		UpLinkPort:   8085,
+		DownLinkIP:   "localhost",
+		DownLinkPort: 8090,
+	},
+	// 同时连接多个上级平台时，每个上级平台使用不同的从链路端口
+	// {
+	// 	Name:         "national",
+	// 	...
+	// 	DownLinkPort: 8091,
+	// },
+}
+
+// 终端上报的定位，单位和 JT/T 808 位置信息汇报一致
 type Req struct {
-	Lon       uint32
-	Lat       uint32
-	Vec1      uint16
-	Vec2      uint16
-	Vec3      uint32
+	Lon       uint32 // 经度，单位为 1e-6 度
+	Lat       uint32 // 纬度，单位为 1e-6 度
+	Vec1      uint16 // 速度，单位为 0.1km/h
+	Vec2      uint16 // 行驶记录速度，单位为 0.1km/h
+	Vec3      uint32 // 里程，单位为 0.1km
 	Direction uint16
 	Altitude  uint16
 }
 
 func main() {
 	logger := log.NewLogdevStdoutLogger(level.AllowDebug())
-	srv := jt809server.NewServer(logger)
-
-	// 设置链接信息
-	srv.UserID = 1
-	srv.Password = "1"
-	srv.GNSSCenterID = 1
-	srv.UpLinkIP = "localhost"
-	srv.UpLinkPort = 8085
-	srv.DownLinkIP = "localhost"
-	srv.DownLinkPort = 8090
-
-	// 链接到监管平台后启动 http 服务接收定位，推送监管平台
-	srv.OnConnect = func() {
-		go func() {
-			defer func() {
-				if err := recover(); err != nil {
-					level.Error(logger).Log(
-						"msg", "simulate panic",
-						"error", err,
-						"stack", debug.Stack())
-				}
-			}()
-			level.Debug(logger).Log("msg", "start simulate")
-			// for {
-			// 	simulate(srv, "测A12345", jt809.PlateColorYellow, time.Second*5)
-			// }
-
-			http.HandleFunc("/bar", func(w http.ResponseWriter, r *http.Request) {
-				s, err := ioutil.ReadAll(r.Body)
-				if err != nil {
-					level.Error(logger).Log("msg", "HandleFunc ReadAll", err)
-				}
-				req := Req{}
-				err = json.Unmarshal(s, &req)
-				if err != nil {
-					level.Error(logger).Log("msg", "HandleFunc Unmarshal", err)
-				}
-				level.Debug(logger).Log("msg", "HandleFunc", "req", fmt.Sprintf("%#v", req))
-
-				exgmsg := jt809.NewUpExgMsg()
-				exgmsg.VehicleNo = jt809.FixedLengthString("测A12345", 21, true)
-				exgmsg.VehicleColor = jt809.PlateColorYellow
-				loc := jt809.NewUpExgMsgRealLocation()
-				loc.Encrypt = 0
-				loc.State = &jt809.LocationStatus{ACC: true, Location: true}
-				loc.Alarm = &jt809.LocationAlarm{}
-
-				now := time.Now()
-				loc.Date = jt809.GNSSDataDate(now)
-				loc.Time = jt809.GNSSDataTime(now)
-				loc.Lon = req.Lon
-				loc.Lat = req.Lat
-				loc.Vec1 = req.Vec1 / 10
-				loc.Vec2 = req.Vec2 / 10
-				loc.Vec3 = req.Vec3 / 10
-				loc.Direction = req.Direction
-				loc.Altitude = req.Altitude
-				exgmsg.SetSubPacket(loc)
-				srv.UpRealLocation(exgmsg)
-			})
+	m := jt809server.NewManager(logger)
 
-			err := http.ListenAndServe(":80", nil)
-			level.Error(logger).Log("msg", "http server", "error", err)
-		}()
-	}
+	for _, u := range upstreams {
+		srv := jt809server.NewServer(kitlog.With(logger, "upstream", u.Name))
+		srv.UserID = u.UserID
+		srv.Password = u.Password
+		srv.GNSSCenterID = u.GNSSCenterID
+		srv.UpLinkIP = u.UpLinkIP
+		srv.UpLinkPort = u.UpLinkPort
+		srv.DownLinkIP = u.DownLinkIP
+		srv.DownLinkPort = u.DownLinkPort
 
-	done := make(chan struct{})
-	go func() {
-		err := srv.Serve()
+		// 链路中断期间的定位信息写入本地文件，重新登录后补报
+		spool, err := jt809server.OpenFileSpool(filepath.Join("spool", u.Name))
+		if err != nil {
+			level.Error(logger).Log("msg", "OpenFileSpool", "error", err)
+			os.Exit(1)
+		}
+		defer spool.Close()
+		srv.Spool = spool
+
+		err = m.Add(u.Name, srv, nil)
 		if err != nil {
-			logger.Log("error", err)
+			level.Error(logger).Log("msg", "Manager Add", "error", err)
 			os.Exit(1)
 		}
+	}
+
+	// 启动 http 服务接收定位，推送所有上级平台
+	go func() {
+		defer func() {
+			if err := recover(); err != nil {
+				level.Error(logger).Log(
+					"msg", "http server panic",
+					"error", err,
+					"stack", debug.Stack())
+			}
+		}()
+
+		http.HandleFunc("/bar", func(w http.ResponseWriter, r *http.Request) {
+			s, err := ioutil.ReadAll(r.Body)
+			if err != nil {
+				level.Error(logger).Log("msg", "HandleFunc ReadAll", err)
+			}
+			req := Req{}
+			err = json.Unmarshal(s, &req)
+			if err != nil {
+				level.Error(logger).Log("msg", "HandleFunc Unmarshal", err)
+			}
+			level.Debug(logger).Log("msg", "HandleFunc", "req", fmt.Sprintf("%#v", req))
+
+			exgmsg := jt809.NewUpExgMsg()
+			exgmsg.VehicleNo = jt809.FixedLengthString("测A12345", 21, true)
+			exgmsg.VehicleColor = jt809.PlateColorYellow
+			loc := jt809.NewUpExgMsgRealLocation()
+			err = loc.SetGNSSData(jt809.GNSSData{
+				Time:          time.Now(),
+				Lon:           float64(req.Lon) / 1e6,
+				Lat:           float64(req.Lat) / 1e6,
+				Speed:         float64(req.Vec1) / 10,
+				RecorderSpeed: float64(req.Vec2) / 10,
+				Mileage:       float64(req.Vec3) / 10,
+				Direction:     req.Direction,
+				Altitude:      req.Altitude,
+				Status:        jt809.LocationStatus{ACC: true, Location: true},
+			})
+			if err != nil {
+				level.Error(logger).Log("msg", "HandleFunc SetGNSSData", "error", err)
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			exgmsg.SetSubPacket(loc)
+			err = m.UpRealLocation(exgmsg)
+			if err != nil {
+				level.Error(logger).Log("msg", "HandleFunc UpRealLocation", "error", err)
+				w.WriteHeader(http.StatusServiceUnavailable)
+			}
+		})
+
+		http.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+			for _, s := range m.Status() {
+				fmt.Fprintf(w, "%s serving:%t uplink:%t downlink:%t loggedin:%t error:%v\n",
+					s.Name, s.Serving, s.UpLink, s.DownLink, s.LoggedIn, s.Err)
+			}
+		})
+
+		err := http.ListenAndServe(":80", nil)
+		level.Error(logger).Log("msg", "http server", "error", err)
+	}()
+
+	done := make(chan struct{})
+	go func() {
+		m.Serve(context.Background())
 		close(done)
 	}()
 
-	waitInterrupt(srv)
+	waitInterrupt(m, logger)
 	<-done
 	level.Info(logger).Log("msg", "server exit")
 }
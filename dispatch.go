@@ -0,0 +1,100 @@
+package jt809server
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sync"
+)
+
+type DispatchMode byte
+
+const (
+	// 同一链路上收到的数据包按接收顺序处理，车辆相关的数据包按车辆保持顺序
+	DispatchOrdered DispatchMode = 0
+	// 数据包在 worker 池中并发处理，不保证顺序
+	DispatchConcurrent DispatchMode = 1
+)
+
+const (
+	defaultDispatchWorkers   = 16
+	defaultDispatchQueueSize = 64
+)
+
+// 车辆相关的数据包实现这个接口，有序分发时同一车辆的数据包按接收顺序处理
+type VehicleKeyer interface {
+	VehicleKey() string
+}
+
+type dispatcher struct {
+	mode   DispatchMode
+	queues []chan received
+	sem    chan struct{}
+	wg     sync.WaitGroup
+	serve  func(received)
+}
+
+func newDispatcher(mode DispatchMode, workers, queueSize int, serve func(received)) *dispatcher {
+	if workers <= 0 {
+		workers = defaultDispatchWorkers
+	}
+	if queueSize <= 0 {
+		queueSize = defaultDispatchQueueSize
+	}
+	d := &dispatcher{mode: mode, serve: serve}
+	if mode == DispatchConcurrent {
+		d.sem = make(chan struct{}, workers)
+		return d
+	}
+
+	d.queues = make([]chan received, workers)
+	for i := range d.queues {
+		q := make(chan received, queueSize)
+		d.queues[i] = q
+		d.wg.Add(1)
+		go func() {
+			defer d.wg.Done()
+			for r := range q {
+				d.serve(r)
+			}
+		}()
+	}
+	return d
+}
+
+func dispatchKey(r received) string {
+	if vk, ok := r.packet.(VehicleKeyer); ok {
+		return "vehicle/" + vk.VehicleKey()
+	}
+	if r.session != nil {
+		return fmt.Sprintf("link/%p/%s", r.session, r.link)
+	}
+	return "link/" + r.link
+}
+
+// 分发数据包，队列或 worker 池满时阻塞，从而对链路的读取形成背压
+func (d *dispatcher) dispatch(r received) {
+	if d.mode == DispatchConcurrent {
+		d.sem <- struct{}{}
+		d.wg.Add(1)
+		go func() {
+			defer func() {
+				<-d.sem
+				d.wg.Done()
+			}()
+			d.serve(r)
+		}()
+		return
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(dispatchKey(r)))
+	d.queues[h.Sum32()%uint32(len(d.queues))] <- r
+}
+
+// 停止分发并等待已分发的数据包处理完成
+func (d *dispatcher) close() {
+	for _, q := range d.queues {
+		close(q)
+	}
+	d.wg.Wait()
+}
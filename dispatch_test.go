@@ -0,0 +1,199 @@
+package jt809server
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lai323/jt809server/jt809"
+)
+
+func TestDispatcherOrdered(t *testing.T) {
+	var (
+		mtx sync.Mutex
+		got = map[string][]uint32{}
+	)
+	d := newDispatcher(DispatchOrdered, 4, 1, func(r received) {
+		mtx.Lock()
+		defer mtx.Unlock()
+		got[r.link] = append(got[r.link], r.packet.Header().SerialNo)
+	})
+	for i := uint32(0); i < 100; i++ {
+		for _, link := range []string{"upconn", "downconn"} {
+			p := jt809.NewDownLinkTestReq()
+			p.Header().SerialNo = i
+			d.dispatch(received{link: link, packet: p})
+		}
+	}
+	d.close()
+
+	for link, sns := range got {
+		if len(sns) != 100 {
+			t.Fatal("dispatcher lost packet", link, len(sns))
+		}
+		for i, sn := range sns {
+			if sn != uint32(i) {
+				t.Fatal("dispatcher out of order", link, sns)
+			}
+		}
+	}
+}
+
+func TestDispatcherVehicle(t *testing.T) {
+	const workers = 4
+	queueOf := func(vehicle string) uint32 {
+		h := fnv.New32a()
+		h.Write([]byte("vehicle/" + vehicle))
+		return h.Sum32() % workers
+	}
+	// 两辆分配到不同 worker 的车辆
+	vehicles := []string{"A0"}
+	for i := 1; len(vehicles) < 2; i++ {
+		if v := fmt.Sprint("A", i); queueOf(v) != queueOf(vehicles[0]) {
+			vehicles = append(vehicles, v)
+		}
+	}
+	location := func(vehicle string, sn uint32) *jt809.UpExgMsg {
+		p := testLocation()
+		p.VehicleNo = jt809.FixedLengthString(vehicle, 21, true)
+		p.Header().SerialNo = sn
+		return p
+	}
+
+	var (
+		mtx      sync.Mutex
+		got      = map[string][]uint32{}
+		inflight = map[string]int{}
+		second   = make(chan struct{})
+		once     sync.Once
+	)
+	d := newDispatcher(DispatchOrdered, workers, 16, func(r received) {
+		vehicle := r.packet.(*jt809.UpExgMsg).VehicleKey()
+		mtx.Lock()
+		inflight[vehicle]++
+		if inflight[vehicle] > 1 {
+			t.Error("packets of the same vehicle should be served serially", vehicle)
+		}
+		mtx.Unlock()
+
+		// 第一辆车的第一个数据包等待第二辆车的数据包处理，不同车辆不能互相阻塞
+		if vehicle == location(vehicles[0], 0).VehicleKey() && r.packet.Header().SerialNo == 0 {
+			select {
+			case <-second:
+			case <-time.After(3 * time.Second):
+				t.Error("packets of different vehicles should be served in parallel")
+			}
+		} else if vehicle == location(vehicles[1], 0).VehicleKey() {
+			once.Do(func() { close(second) })
+		}
+
+		mtx.Lock()
+		inflight[vehicle]--
+		got[vehicle] = append(got[vehicle], r.packet.Header().SerialNo)
+		mtx.Unlock()
+	})
+	for _, vehicle := range vehicles {
+		for i := uint32(0); i < 10; i++ {
+			d.dispatch(received{link: "upconn", packet: location(vehicle, i)})
+		}
+	}
+	d.close()
+
+	for vehicle, sns := range got {
+		for i, sn := range sns {
+			if sn != uint32(i) {
+				t.Fatal("dispatcher out of order", vehicle, sns)
+			}
+		}
+	}
+	if len(got) != 2 {
+		t.Error("dispatcher lost vehicle", got)
+	}
+}
+
+func TestDispatcherConcurrent(t *testing.T) {
+	const workers = 4
+	var (
+		mtx      sync.Mutex
+		inflight int
+		max      int
+		served   int
+		full     = make(chan struct{})
+	)
+	d := newDispatcher(DispatchConcurrent, workers, 0, func(r received) {
+		mtx.Lock()
+		inflight++
+		if inflight > max {
+			max = inflight
+		}
+		if inflight == workers && max == workers && served == 0 {
+			close(full)
+		}
+		mtx.Unlock()
+
+		// 同一链路的数据包也并发处理，前 workers 个数据包同时处理中
+		select {
+		case <-full:
+		case <-time.After(3 * time.Second):
+			t.Error("packets should be served concurrently")
+		}
+
+		mtx.Lock()
+		inflight--
+		served++
+		mtx.Unlock()
+	})
+	for i := 0; i < 20; i++ {
+		d.dispatch(received{link: "upconn", packet: jt809.NewDownLinkTestReq()})
+	}
+	d.close()
+
+	if served != 20 {
+		t.Error("dispatcher lost packet", served)
+	}
+	if max != workers {
+		t.Error("concurrent packets should be bounded by workers", max)
+	}
+}
+
+func TestDispatcherWorkers(t *testing.T) {
+	for _, mode := range []DispatchMode{DispatchOrdered, DispatchConcurrent} {
+		const workers = 3
+		var (
+			mtx      sync.Mutex
+			inflight int
+			max      int
+		)
+		d := newDispatcher(mode, workers, 1, func(r received) {
+			mtx.Lock()
+			inflight++
+			if inflight > max {
+				max = inflight
+			}
+			mtx.Unlock()
+			time.Sleep(time.Millisecond)
+			mtx.Lock()
+			inflight--
+			mtx.Unlock()
+		})
+		if mode == DispatchOrdered && len(d.queues) != workers {
+			t.Error("ordered dispatcher should start one queue per worker", len(d.queues))
+		}
+		// 每个数据包来自不同的链路，处理的 goroutine 数量仍然不超过 workers
+		for i := 0; i < 50; i++ {
+			d.dispatch(received{link: fmt.Sprint("link", i), packet: jt809.NewDownLinkTestReq()})
+		}
+		d.close()
+		if max > workers {
+			t.Error("dispatcher should not serve more than workers packets at once", mode, max)
+		}
+	}
+
+	d := newDispatcher(DispatchOrdered, 0, 0, func(received) {})
+	defer d.close()
+	if len(d.queues) != defaultDispatchWorkers || cap(d.queues[0]) != defaultDispatchQueueSize {
+		t.Error("dispatcher default workers error", len(d.queues), cap(d.queues[0]))
+	}
+}
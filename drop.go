@@ -0,0 +1,58 @@
+package jt809server
+
+import (
+	"runtime/debug"
+	"sync/atomic"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/lai323/jt809server/jt809"
+)
+
+// 丢弃无法解码的帧或者数据包时调用，err.Kind 为 jt809.PacketError 时可以通过 ctx.Reply 向对方发送应答
+type DropFunc func(ctx *Context, err *jt809.DecodeError)
+
+// 因为解码错误丢弃的帧和数据包数量
+type DropCounters struct {
+	Frames  uint64 // 帧的长度、校验码或者数据头错误
+	Packets uint64 // 数据包无法解码，例如不支持的业务类型
+}
+
+// 原子操作的 DropCounters
+type dropCounter struct {
+	frames  uint64
+	packets uint64
+}
+
+func (c *dropCounter) add(err *jt809.DecodeError) {
+	if err.Kind == jt809.PacketError {
+		atomic.AddUint64(&c.packets, 1)
+		return
+	}
+	atomic.AddUint64(&c.frames, 1)
+}
+
+func (c *dropCounter) load() DropCounters {
+	return DropCounters{
+		Frames:  atomic.LoadUint64(&c.frames),
+		Packets: atomic.LoadUint64(&c.packets),
+	}
+}
+
+// 记录并回调丢弃的帧，回调 panic 不影响链路的读取
+func drop(c *dropCounter, f DropFunc, ctx *Context, err *jt809.DecodeError, logger log.Logger) {
+	c.add(err)
+	level.Warn(logger).Log("msg", "drop frame", "conn", ctx.Link, "error", err)
+	if f == nil {
+		return
+	}
+	defer func() {
+		if err := recover(); err != nil {
+			level.Error(logger).Log(
+				"msg", "OnDrop panic",
+				"error", err,
+				"stack", debug.Stack())
+		}
+	}()
+	f(ctx, err)
+}
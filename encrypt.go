@@ -0,0 +1,52 @@
+package jt809server
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+
+	"github.com/lai323/jt809server/jt809"
+)
+
+// 报文加密配置，收到的加密报文总是按配置的算法解密
+type EncryptConfig struct {
+	// 为 true 时发送的报文使用随机密钥加密
+	Enable bool
+	// XOR 加密常量，由上级平台分配，为空时使用 jt809.DefaultEncryptParams
+	Params jt809.EncryptParams
+	// 加密算法，例如 jt809.NewSM4Cipher 返回的 SM4 加密，为空时使用 Params 的 XOR 加密
+	Cipher jt809.Cipher
+}
+
+func (c EncryptConfig) cipher() jt809.Cipher {
+	if c.Cipher != nil {
+		return c.Cipher
+	}
+	if c.Params == (jt809.EncryptParams{}) {
+		return jt809.XORCipher{Params: jt809.DefaultEncryptParams}
+	}
+	return jt809.XORCipher{Params: c.Params}
+}
+
+func (c EncryptConfig) options() []jt809.Option {
+	return []jt809.Option{jt809.WithCipher(c.cipher())}
+}
+
+func (c EncryptConfig) setHeader(h *jt809.Header) {
+	if !c.Enable {
+		h.Encrypt = 0
+		h.EncryptKey = 0
+		return
+	}
+	h.Encrypt = 1
+	// 密钥为 0 时加密算法按 1 处理，这里直接避免使用 0
+	h.EncryptKey = randUint32()%0xfffffffe + 1
+}
+
+// 加密密钥和登录校验码使用 crypto/rand，math/rand 在 Go 1.20 之前默认不初始化种子，生成的值可以预测
+func randUint32() uint32 {
+	var b [4]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err)
+	}
+	return binary.BigEndian.Uint32(b[:])
+}
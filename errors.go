@@ -0,0 +1,30 @@
+package jt809server
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/lai323/jt809server/jt809"
+)
+
+var (
+	// 已经调用了 Shutdown
+	ErrServerClosed = errors.New("jt809server server closed")
+	// 数据包需要的链路没有建立或者已经断开
+	ErrLinkUnavailable = errors.New("jt809server link unavailable")
+	// 主链路还没有登录成功
+	ErrNotLoggedIn = errors.New("jt809server not logged in")
+	// SuperiorServer 没有设置 Authenticator，不能验证下级平台登录
+	ErrNoAuthenticator = errors.New("jt809server superior server Authenticator is nil")
+)
+
+type EncodeError struct {
+	Packet jt809.Packet
+	Err    error
+}
+
+func (e *EncodeError) Error() string {
+	return fmt.Sprintf("jt809server encode %s error: %s", e.Packet, e.Err)
+}
+
+func (e *EncodeError) Unwrap() error { return e.Err }
@@ -5,7 +5,6 @@ go 1.14
 require (
 	github.com/go-kit/log v0.2.0
 	github.com/go-logfmt/logfmt v0.5.1
-	github.com/howeyc/crc16 v0.0.0-20171223171357-2b2a61e366a6
 	github.com/lai323/bytecodec v0.1.2
 	golang.org/x/text v0.3.6
 )
@@ -0,0 +1,150 @@
+package jt809server
+
+import (
+	"context"
+	"runtime/debug"
+	"sync"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/lai323/jt809server/jt809"
+)
+
+// 注册处理函数时使用 AnySubType 匹配一个业务数据类型下的所有子业务类型
+const AnySubType uint16 = 0
+
+// 处理函数的上下文，Link 是收到数据包的链路，可以通过 Reply 回复数据包
+// 下级平台模式 Server 不为空，上级平台模式 Session 不为空
+type Context struct {
+	context.Context
+	Link string
+
+	srv     *Server
+	session *Session
+}
+
+func (c *Context) Server() *Server {
+	return c.srv
+}
+
+func (c *Context) Session() *Session {
+	return c.session
+}
+
+// 回复数据包，发送时使用的链路由数据包的 LinkType 决定
+func (c *Context) Reply(p jt809.Packet) error {
+	if c.session != nil {
+		return c.session.send(p)
+	}
+	return c.srv.send(p)
+}
+
+type HandlerFunc func(ctx *Context, p jt809.Packet)
+
+// 中间件包装 HandlerFunc，用于日志、recover、统计等通用逻辑
+type Middleware func(next HandlerFunc) HandlerFunc
+
+type handlerKey struct {
+	Type    uint16
+	SubType uint16
+}
+
+// 按业务数据类型和子业务类型分发数据包
+// 对于包含子业务的数据包，优先匹配 (Type, SubType)，没有找到时匹配 (Type, AnySubType)
+type ServeMux struct {
+	mtx         sync.RWMutex
+	handlers    map[handlerKey]HandlerFunc
+	middlewares []Middleware
+
+	// 没有匹配的处理函数时调用
+	NotFound HandlerFunc
+}
+
+func NewServeMux() *ServeMux {
+	return &ServeMux{
+		handlers: map[handlerKey]HandlerFunc{},
+	}
+}
+
+// 注册处理函数，已注册的处理函数会被替换，h 为 nil 时删除
+func (mux *ServeMux) HandleFunc(t, subType uint16, h HandlerFunc) {
+	mux.mtx.Lock()
+	defer mux.mtx.Unlock()
+	k := handlerKey{Type: t, SubType: subType}
+	if h == nil {
+		delete(mux.handlers, k)
+		return
+	}
+	mux.handlers[k] = h
+}
+
+// 返回已注册的处理函数，可以用于包装默认处理函数
+func (mux *ServeMux) Handler(t, subType uint16) HandlerFunc {
+	mux.mtx.RLock()
+	defer mux.mtx.RUnlock()
+	return mux.handlers[handlerKey{Type: t, SubType: subType}]
+}
+
+// 添加中间件，先添加的在外层
+func (mux *ServeMux) Use(mws ...Middleware) {
+	mux.mtx.Lock()
+	defer mux.mtx.Unlock()
+	mux.middlewares = append(mux.middlewares, mws...)
+}
+
+func (mux *ServeMux) match(p jt809.Packet) HandlerFunc {
+	mux.mtx.RLock()
+	defer mux.mtx.RUnlock()
+	t := p.Header().Type
+	if subSetter, ok := p.(jt809.SubPacketSetter); ok {
+		if h := mux.handlers[handlerKey{Type: t, SubType: subSetter.SubType()}]; h != nil {
+			return h
+		}
+	}
+	if h := mux.handlers[handlerKey{Type: t, SubType: AnySubType}]; h != nil {
+		return h
+	}
+	return mux.NotFound
+}
+
+func (mux *ServeMux) ServePacket(ctx *Context, p jt809.Packet) {
+	h := mux.match(p)
+	if h == nil {
+		return
+	}
+
+	mux.mtx.RLock()
+	mws := mux.middlewares
+	mux.mtx.RUnlock()
+	for i := len(mws) - 1; i >= 0; i-- {
+		h = mws[i](h)
+	}
+	h(ctx, p)
+}
+
+func LoggingMiddleware(logger log.Logger) Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(ctx *Context, p jt809.Packet) {
+			level.Debug(logger).Log("msg", "handle", "conn", ctx.Link, "packet", p)
+			next(ctx, p)
+		}
+	}
+}
+
+// 捕获处理函数的 panic，避免影响同一次分发中的其他逻辑
+func RecoverMiddleware(logger log.Logger) Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(ctx *Context, p jt809.Packet) {
+			defer func() {
+				if err := recover(); err != nil {
+					level.Error(logger).Log(
+						"msg", "handler panic",
+						"packet", p,
+						"error", err,
+						"stack", debug.Stack())
+				}
+			}()
+			next(ctx, p)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package jt809
+
+import (
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+)
+
+// 报文数据体的加密算法，数据头 Encrypt 为 1 时使用
+// key 是数据头中的 EncryptKey，加解密可能改变数据体长度，data 可能被修改
+type Cipher interface {
+	Encrypt(key uint32, data []byte) ([]byte, error)
+	Decrypt(key uint32, data []byte) ([]byte, error)
+}
+
+// 标准中的 XOR 加密算法，EncryptKey 是加密密钥
+type XORCipher struct {
+	Params EncryptParams
+}
+
+func (c XORCipher) Encrypt(key uint32, data []byte) ([]byte, error) {
+	Encrypt(c.Params.M1, c.Params.IA1, c.Params.IC1, key, data)
+	return data, nil
+}
+
+func (c XORCipher) Decrypt(key uint32, data []byte) ([]byte, error) {
+	Encrypt(c.Params.M1, c.Params.IA1, c.Params.IC1, key, data)
+	return data, nil
+}
+
+var ErrSM4Padding = errors.New("jt809 SM4 invalid padding")
+
+// SM4 CBC 模式加密，PKCS#7 填充
+// 初始向量是 EncryptKey 重复 4 次，发送时每个报文使用随机的 EncryptKey 即可得到不同的初始向量
+// 密钥由上下级平台预先约定，或者通过 SM2 密钥交换得到
+type SM4Cipher struct {
+	block cipher.Block
+}
+
+func NewSM4Cipher(key []byte) (*SM4Cipher, error) {
+	block, err := NewSM4(key)
+	if err != nil {
+		return nil, err
+	}
+	return &SM4Cipher{block: block}, nil
+}
+
+func sm4IV(key uint32) []byte {
+	iv := make([]byte, SM4BlockSize)
+	for i := 0; i < SM4BlockSize; i += 4 {
+		binary.BigEndian.PutUint32(iv[i:], key)
+	}
+	return iv
+}
+
+func (c *SM4Cipher) Encrypt(key uint32, data []byte) ([]byte, error) {
+	padding := SM4BlockSize - len(data)%SM4BlockSize
+	ret := make([]byte, len(data)+padding)
+	copy(ret, data)
+	for i := len(data); i < len(ret); i++ {
+		ret[i] = byte(padding)
+	}
+	cipher.NewCBCEncrypter(c.block, sm4IV(key)).CryptBlocks(ret, ret)
+	return ret, nil
+}
+
+func (c *SM4Cipher) Decrypt(key uint32, data []byte) ([]byte, error) {
+	if len(data) == 0 || len(data)%SM4BlockSize != 0 {
+		return nil, ErrSM4Padding
+	}
+	ret := make([]byte, len(data))
+	cipher.NewCBCDecrypter(c.block, sm4IV(key)).CryptBlocks(ret, data)
+	padding := int(ret[len(ret)-1])
+	if padding == 0 || padding > SM4BlockSize {
+		return nil, ErrSM4Padding
+	}
+	for _, b := range ret[len(ret)-padding:] {
+		if int(b) != padding {
+			return nil, ErrSM4Padding
+		}
+	}
+	return ret[:len(ret)-padding], nil
+}
@@ -0,0 +1,68 @@
+package jt809
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+// GB/T 32907-2016 附录 A 示例
+func TestSM4(t *testing.T) {
+	key := mustHexDecodeString("0123456789abcdeffedcba9876543210")
+	plain := mustHexDecodeString("0123456789abcdeffedcba9876543210")
+	want := mustHexDecodeString("681edf34d206965e86b3e94f536e4246")
+
+	block, err := NewSM4(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst := make([]byte, SM4BlockSize)
+	block.Encrypt(dst, plain)
+	if !bytes.Equal(dst, want) {
+		t.Errorf("SM4 Encrypt error %x", dst)
+	}
+	block.Decrypt(dst, dst)
+	if !bytes.Equal(dst, plain) {
+		t.Errorf("SM4 Decrypt error %x", dst)
+	}
+
+	_, err = NewSM4(key[:8])
+	if err == nil {
+		t.Error("SM4 should reject short key")
+	}
+}
+
+func TestSM4Cipher(t *testing.T) {
+	c, err := NewSM4Cipher(mustHexDecodeString("0123456789abcdeffedcba9876543210"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := NewUpConnectReq()
+	h := p.Header()
+	h.Encrypt = 1
+	h.EncryptKey = 809
+	p.UserID = 1
+	p.Password = FixedLengthString("1", 8, false)
+	p.DownLinkIP = FixedLengthString("127.0.0.1", 32, false)
+
+	data, err := Marshal(p, WithCipher(c))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ret, err := Unmarshal(data, WithCipher(c))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(ret, p) {
+		t.Error("SM4Cipher roundtrip error", p, ret)
+	}
+
+	if p.Header().Length%SM4BlockSize != (1+HeaderLength+1+2)%SM4BlockSize {
+		t.Error("SM4Cipher body should be padded", p.Header().Length)
+	}
+
+	_, err = c.Decrypt(809, make([]byte, 15))
+	if err != ErrSM4Padding {
+		t.Error("SM4Cipher Decrypt should check length", err)
+	}
+}
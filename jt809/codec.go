@@ -1,13 +1,13 @@
 package jt809
 
 import (
-	"bufio"
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
+	"sync"
 
-	"github.com/howeyc/crc16"
 	"github.com/lai323/bytecodec"
 )
 
@@ -18,20 +18,115 @@ const (
 	EndEscapeChar   byte = 0x5e
 )
 
-func Marshal(p Packet) ([]byte, error) {
-	buf := &bytes.Buffer{}
-	enc := NewEncoder(buf)
-	err := enc.Encode(p)
-	return buf.Bytes(), err
+func Marshal(p Packet, opts ...Option) ([]byte, error) {
+	return AppendPacket(nil, p, opts...)
 }
 
-func Unmarshal(data []byte) (Packet, error) {
+func Unmarshal(data []byte, opts ...Option) (Packet, error) {
 	buf := bytes.NewBuffer(data)
-	dec := NewDecoder(buf)
+	dec := NewDecoder(buf, opts...)
 	p, err := dec.Decode()
 	return p, err
 }
 
+// 报文加密算法使用的常量，由上级平台分配给下级平台
+type EncryptParams struct {
+	M1  uint32
+	IA1 uint32
+	IC1 uint32
+}
+
+var DefaultEncryptParams = EncryptParams{M1: 30000000, IA1: 20000000, IC1: 20000000}
+
+type codecOptions struct {
+	cipher       Cipher
+	cipherFunc   func(gnssCenterID uint32) Cipher
+	protocol     Protocol
+	maxFrameSize int
+	crc          *CRC16
+	validation   Validation
+}
+
+func newCodecOptions(opts []Option) codecOptions {
+	o := codecOptions{cipher: XORCipher{Params: DefaultEncryptParams}, crc: CRC16CCITTFalse}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// Encoder 和 Decoder 的选项
+type Option func(*codecOptions)
+
+// 设置 XOR 加密算法使用的常量，默认 DefaultEncryptParams
+func WithEncryptParams(params EncryptParams) Option {
+	return WithCipher(XORCipher{Params: params})
+}
+
+// 设置报文加密算法，默认使用 DefaultEncryptParams 的 XORCipher
+func WithCipher(c Cipher) Option {
+	return func(o *codecOptions) {
+		o.cipher = c
+	}
+}
+
+// 解码时按数据头中的接入码选择加密算法，返回 nil 时使用 WithCipher 设置的算法
+// 用于上级平台为不同的下级平台使用不同的密钥
+func WithCipherFunc(f func(gnssCenterID uint32) Cipher) Option {
+	return func(o *codecOptions) {
+		o.cipherFunc = f
+	}
+}
+
+// 设置数据头的协议版本，默认 Protocol2011
+func WithProtocol(p Protocol) Option {
+	return func(o *codecOptions) {
+		o.protocol = p
+	}
+}
+
+// 设置编码和校验使用的 CRC16 算法，为空时使用默认的 CRC16CCITTFalse
+func WithCRC16(c *CRC16) Option {
+	return func(o *codecOptions) {
+		if c == nil {
+			c = CRC16CCITTFalse
+		}
+		o.crc = c
+	}
+}
+
+// 解码时对长度的校验方式
+type Validation byte
+
+const (
+	// 只拒绝无法解码的长度，例如子业务数据长度超过数据体，默认使用
+	ValidateLenient Validation = 0
+	// 数据头中的长度必须和帧一致，数据体、子业务数据体不能有多余或者缺少的字节
+	ValidateStrict Validation = 1
+)
+
+var (
+	// 数据头中的长度和帧的长度不一致，或者数据体长度和数据包的格式不一致
+	ErrLengthMismatch = errors.New("jt809 length mismatch")
+	// 子业务数据长度超过数据体的长度
+	ErrSubLengthOverflow = errors.New("jt809 sub length overflow")
+)
+
+// 设置解码时的长度校验方式，默认 ValidateLenient
+func WithValidation(v Validation) Option {
+	return func(o *codecOptions) {
+		o.validation = v
+	}
+}
+
+// 设置解码时的最大帧长度，默认 DefaultMaxFrameSize
+func WithMaxFrameSize(n int) Option {
+	return func(o *codecOptions) {
+		o.maxFrameSize = n
+	}
+}
+
+// 解码时没有注册的类型返回 RawPacket，不再返回这个错误
 type UnsupportPacketErr struct {
 	Type uint16
 }
@@ -40,6 +135,7 @@ func (e *UnsupportPacketErr) Error() string {
 	return fmt.Sprintf("jt809 unsupport packet %#04x", e.Type)
 }
 
+// 解码时没有注册的子业务类型返回 RawSubPacket，不再返回这个错误
 type UnsupportSubPacketErr struct {
 	Type uint16
 }
@@ -48,86 +144,205 @@ func (e *UnsupportSubPacketErr) Error() string {
 	return fmt.Sprintf("jt809 unsupport subpacket %#04x", e.Type)
 }
 
+// 解码错误的类别
+type DecodeErrorKind byte
+
+const (
+	// 帧的长度、校验码或者数据头错误，丢弃这一帧之后可以继续读取
+	FrameError DecodeErrorKind = 1
+	// 帧完整但是数据包无法解码，例如不支持的业务类型、数据体长度不足
+	PacketError DecodeErrorKind = 2
+	// 连接已经不可用，例如读取到不完整的帧时连接结束
+	TransportError DecodeErrorKind = 3
+)
+
+func (k DecodeErrorKind) String() string {
+	switch k {
+	case FrameError:
+		return "frame"
+	case PacketError:
+		return "packet"
+	case TransportError:
+		return "transport"
+	}
+	return fmt.Sprintf("DecodeErrorKind(%d)", byte(k))
+}
+
+// Frame 是原始的帧，Header 只在 PacketError 时不为空
+type DecodeError struct {
+	Kind   DecodeErrorKind
+	Frame  []byte
+	Header *Header
+	Err    error
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("jt809 decode %s error: %s", e.Kind, e.Err)
+}
+
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+// 是否可以丢弃出错的帧继续解码
+func (e *DecodeError) Recoverable() bool {
+	return e.Kind == FrameError || e.Kind == PacketError
+}
+
 type Decoder struct {
-	r *bufio.Reader
+	r    *FrameReader
+	opts codecOptions
 }
 
-func NewDecoder(r io.Reader) *Decoder {
+func NewDecoder(r io.Reader, opts ...Option) *Decoder {
+	o := newCodecOptions(opts)
 	return &Decoder{
-		r: bufio.NewReader(r),
+		r:    NewFrameReader(r, o.maxFrameSize),
+		opts: o,
 	}
 }
 
+// 解码出错时返回 *DecodeError，连接读取错误原样返回，例如 io.EOF
+// Kind 为 FrameError 或者 PacketError 时可以继续调用 Decode 读取下一帧
 func (c *Decoder) Decode() (p Packet, err error) {
-	pktbytes, err := ReadPacket(c.r)
+	frame, err := c.r.ReadFrame()
 	if err != nil {
+		switch err.(type) {
+		case *FrameTooLargeErr:
+			return nil, &DecodeError{Kind: FrameError, Err: err}
+		case *TruncatedFrameErr:
+			return nil, &DecodeError{Kind: TransportError, Err: err}
+		}
 		return nil, err
 	}
-	pktbytes, err = RawPacketBytes(pktbytes)
+	return c.decodeFrame(frame)
+}
+
+func (c *Decoder) decodeFrame(frame []byte) (Packet, error) {
+	pktbytes, err := rawPacketBytes(frame, c.opts.crc)
+	if err != nil {
+		return nil, &DecodeError{Kind: FrameError, Frame: frame, Err: err}
+	}
 
 	header := Header{}
-	err = bytecodec.Unmarshal(pktbytes[:HeaderLength], &header)
+	err = header.unmarshal(pktbytes, c.opts.protocol)
 	if err != nil {
-		return nil, fmt.Errorf("jt809 Decode Header Unmarshal error: %s", err)
+		return nil, &DecodeError{Kind: FrameError, Frame: frame, Err: err}
+	}
+	packetErr := func(err error) error {
+		return &DecodeError{Kind: PacketError, Frame: frame, Header: &header, Err: err}
 	}
-	pktbytes = pktbytes[HeaderLength:]
+	strict := c.opts.validation == ValidateStrict
+	// 数据头中的长度包括头尾标识和校验码，不包括转义增加的字节
+	if length := len(pktbytes) + 4; strict && int64(header.Length) != int64(length) {
+		return nil, packetErr(fmt.Errorf("%w: header length %d, frame length %d", ErrLengthMismatch, header.Length, length))
+	}
+	pktbytes = pktbytes[c.opts.protocol.HeaderLength():]
 
 	if header.Encrypt == 1 {
-		var (
-			M1  uint32 = 30000000
-			IA1 uint32 = 20000000
-			IC1 uint32 = 20000000
-		)
-		Encrypt(M1, IA1, IC1, header.EncryptKey, pktbytes)
+		cipher := c.opts.cipher
+		if c.opts.cipherFunc != nil {
+			if selected := c.opts.cipherFunc(header.GNSSCenterID); selected != nil {
+				cipher = selected
+			}
+		}
+		pktbytes, err = cipher.Decrypt(header.EncryptKey, pktbytes)
+		if err != nil {
+			return nil, packetErr(fmt.Errorf("jt809 Decode Decrypt error: %s", err))
+		}
 	}
 
-	new := newPacketMap[header.Type]
+	new := lookupPacket(header.Type)
 	if new == nil {
-		return nil, &UnsupportPacketErr{Type: header.Type}
+		// 没有注册的类型保留原始数据体
+		raw := &RawPacket{headerSetter: &headerSetter{}, Body: pktbytes}
+		raw.SetHeader(header)
+		return raw, nil
 	}
 	pkt := new()
 	err = bytecodec.Unmarshal(pktbytes, pkt)
 	if err != nil {
-		return nil, fmt.Errorf("jt809 Decode Packet Unmarshal error: %s", err)
+		return nil, packetErr(fmt.Errorf("jt809 Decode Packet Unmarshal error: %s", err))
 	}
 	pkt.SetHeader(header)
 
-	if subSetter, ok := pkt.(SubPacketSetter); ok {
-		subnew := newSubPacketMap[subSetter.SubType()]
-		if subnew == nil {
-			return nil, &UnsupportSubPacketErr{Type: header.Type}
+	subSetter, ok := pkt.(SubPacketSetter)
+	if !ok {
+		if strict {
+			if err := checkBodyLength(pkt, len(pktbytes)); err != nil {
+				return nil, packetErr(err)
+			}
 		}
-		subpkt := subnew()
-		err = bytecodec.Unmarshal(pktbytes[len(pktbytes)-int(subSetter.SubLength()):], subpkt)
-		if err != nil {
-			return nil, fmt.Errorf("jt809 Decode SubPacket Unmarshal error: %s", err)
+		return pkt, nil
+	}
+
+	if int64(subSetter.SubLength()) > int64(len(pktbytes)) {
+		return nil, packetErr(fmt.Errorf("%w: sub length %d, body length %d", ErrSubLengthOverflow, subSetter.SubLength(), len(pktbytes)))
+	}
+	subbytes := pktbytes[len(pktbytes)-int(subSetter.SubLength()):]
+	if strict {
+		if err := checkBodyLength(pkt, len(pktbytes)-len(subbytes)); err != nil {
+			return nil, packetErr(err)
 		}
-		subSetter.SetSubPacket(subpkt)
 	}
+	subnew := lookupSubPacket(header.Type, subSetter.SubType())
+	if subnew == nil {
+		subSetter.SetSubPacket(NewRawSubPacket(subSetter.SubType(), subbytes))
+		return pkt, nil
+	}
+	subpkt := subnew()
+	err = bytecodec.Unmarshal(subbytes, subpkt)
+	if err != nil {
+		return nil, packetErr(fmt.Errorf("jt809 Decode SubPacket Unmarshal error: %s", err))
+	}
+	if strict {
+		if err := checkBodyLength(subpkt, len(subbytes)); err != nil {
+			return nil, packetErr(err)
+		}
+	}
+	subSetter.SetSubPacket(subpkt)
 	return pkt, nil
 }
 
-type Encoder struct {
-	w *bufio.Writer
+// 重新编码解码后的数据包，长度应该和收到的数据体一致，不一致说明数据体有多余或者缺少的字节
+func checkBodyLength(v interface{}, length int) error {
+	b, err := bytecodec.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("jt809 Decode check length Marshal error: %s", err)
+	}
+	if len(b) != length {
+		return fmt.Errorf("%w: body length %d, should be %d", ErrLengthMismatch, length, len(b))
+	}
+	return nil
 }
 
-func NewEncoder(w io.Writer) *Encoder {
-	return &Encoder{
-		w: bufio.NewWriter(w),
-	}
+// 编码使用的临时缓冲区，超过 maxPooledBufferSize 的不放回，避免偶尔的大包长期占用内存
+const maxPooledBufferSize = 64 << 10
+
+var bufferPool = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, 0, 512)
+		return &b
+	},
 }
 
-func (c *Encoder) Encode(p Packet) error {
+var zeroHeader [HeaderLength2019]byte
 
+// 编码 p 并把完整的帧追加到 dst，返回追加后的 slice
+// 除了数据体的反射编码，dst 容量足够时不再分配内存
+func AppendPacket(dst []byte, p Packet, opts ...Option) ([]byte, error) {
+	o := newCodecOptions(opts)
+	return o.appendPacket(dst, p)
+}
+
+func (o *codecOptions) appendPacket(dst []byte, p Packet) ([]byte, error) {
 	var subpktBytes []byte
 	if subSetter, ok := p.(SubPacketSetter); ok {
 		subpkt := subSetter.SubPacket()
 		var err error
 		subpktBytes, err = bytecodec.Marshal(subpkt)
 		if err != nil {
-			if err != nil {
-				return fmt.Errorf("jt809 Encode SubPacket Marshal error: %s", err)
-			}
+			return dst, fmt.Errorf("jt809 Encode SubPacket Marshal error: %s", err)
 		}
 		subSetter.SetSubType(subpkt.SubType())
 		subSetter.SetSubLength(uint32(len(subpktBytes)))
@@ -135,66 +350,78 @@ func (c *Encoder) Encode(p Packet) error {
 
 	bodybytes, err := bytecodec.Marshal(p)
 	if err != nil {
-		if err != nil {
-			return fmt.Errorf("jt809 Encode Packet Marshal error: %s", err)
-		}
+		return dst, fmt.Errorf("jt809 Encode Packet Marshal error: %s", err)
 	}
-	bodybytes = append(bodybytes, subpktBytes...)
+
+	bp := bufferPool.Get().(*[]byte)
+	defer func() {
+		if cap(*bp) <= maxPooledBufferSize {
+			bufferPool.Put(bp)
+		}
+	}()
+
+	// 数据头的长度依赖加密后的数据体，先预留位置
+	hl := o.protocol.HeaderLength()
+	buf := append((*bp)[:0], zeroHeader[:hl]...)
+	buf = append(buf, bodybytes...)
+	buf = append(buf, subpktBytes...)
 
 	header := p.Header()
 	if header.Encrypt == 1 {
-		var (
-			M1  uint32 = 30000000
-			IA1 uint32 = 20000000
-			IC1 uint32 = 20000000
-		)
-		Encrypt(M1, IA1, IC1, header.EncryptKey, bodybytes)
+		encrypted, err := o.cipher.Encrypt(header.EncryptKey, buf[hl:])
+		if err != nil {
+			*bp = buf
+			return dst, fmt.Errorf("jt809 Encode Encrypt error: %s", err)
+		}
+		buf = append(buf[:hl], encrypted...)
 	}
 
-	header.Length = 1 + HeaderLength + uint32(len(bodybytes)) + 1 + 2
-	headerbytes, err := bytecodec.Marshal(header)
-	if err != nil {
-		return fmt.Errorf("jt809 Encode Header Marshal error: %s", err)
-	}
-	pktbytes := append(headerbytes, bodybytes...)
+	header.Length = 1 + uint32(len(buf)) + 1 + 2
+	header.put(buf[:hl], o.protocol)
+	buf = append(buf, 0, 0)
+	binary.BigEndian.PutUint16(buf[len(buf)-2:], o.crc.Checksum(buf[:len(buf)-2]))
+	*bp = buf
 
-	sumbyte := make([]byte, 2)
-	binary.BigEndian.PutUint16(sumbyte, crc16.ChecksumCCITTFalse(pktbytes))
-	pktbytes = append(pktbytes, sumbyte...)
+	dst = append(dst, BeginDelimiter)
+	dst = AppendEscape(dst, buf)
+	dst = append(dst, EndDelimiter)
+	return dst, nil
+}
+
+// Encoder 复用编码缓冲区，每条连接使用一个 Encoder，不能并发使用
+type Encoder struct {
+	w    io.Writer
+	buf  []byte
+	opts codecOptions
+}
+
+func NewEncoder(w io.Writer, opts ...Option) *Encoder {
+	return &Encoder{
+		w:    w,
+		opts: newCodecOptions(opts),
+	}
+}
 
-	pktbytes = Escape(pktbytes)
-	pktbytes = append([]byte{BeginDelimiter}, pktbytes...)
-	pktbytes = append(pktbytes, EndDelimiter)
-	_, err = c.w.Write(pktbytes)
+// 编码并一次写入一个完整的帧
+func (c *Encoder) Encode(p Packet) error {
+	var err error
+	c.buf, err = c.opts.appendPacket(c.buf[:0], p)
 	if err != nil {
 		return err
 	}
-	return c.w.Flush()
+	_, err = c.w.Write(c.buf)
+	return err
 }
 
-func ReadPacket(r io.Reader) ([]byte, error) {
-	var (
-		pkt   []byte
-		buff  = make([]byte, 1)
-		found bool
-	)
-	for {
-		_, err := r.Read(buff)
-		if err != nil {
-			return nil, err
-		}
-		if !found && buff[0] == BeginDelimiter {
-			found = true
-			pkt = append(pkt, buff[0])
-			continue
-		}
-		pkt = append(pkt, buff[0])
+// 使用 Encoder 的选项编码 p 并追加到 dst，不写入 w
+func (c *Encoder) Append(dst []byte, p Packet) ([]byte, error) {
+	return c.opts.appendPacket(dst, p)
+}
 
-		if buff[0] == EndDelimiter {
-			break
-		}
-	}
-	return pkt, nil
+// 读取一个完整的帧，r 不是 *bufio.Reader 时可能读取超过一帧的数据
+// 连续读取时使用 FrameReader
+func ReadPacket(r io.Reader) ([]byte, error) {
+	return NewFrameReader(r, DefaultMaxFrameSize).ReadFrame()
 }
 
 type WrongCRC16CCITTError struct {
@@ -209,12 +436,22 @@ func (e *WrongCRC16CCITTError) Error() string {
 
 // 返回已验证的，去掉头尾标识符、校验码的 bytes
 // 这是一个新的 byte slice 不是原 slice 的切片
-// 验证异常返回 &WrongBCCError{dst, bcc, should}
+// 验证异常返回 &WrongCRC16CCITTError{src, sum, should}，长度不足时返回 *TruncatedFrameErr
 func RawPacketBytes(src []byte) ([]byte, error) {
+	return rawPacketBytes(src, CRC16CCITTFalse)
+}
+
+func rawPacketBytes(src []byte, crc *CRC16) ([]byte, error) {
+	if len(src) < 4 {
+		return nil, &TruncatedFrameErr{Size: len(src)}
+	}
 	src = UnEscape(src[1 : len(src)-1])
+	if len(src) < 2 {
+		return nil, &TruncatedFrameErr{Size: len(src)}
+	}
 	sum := binary.BigEndian.Uint16(src[len(src)-2:])
 	content := src[:len(src)-2]
-	if should := crc16.ChecksumCCITT(content); sum != should {
+	if should := crc.Checksum(content); sum != should {
 		return content, &WrongCRC16CCITTError{Src: src, Sum: sum, Should: should}
 	}
 	return content, nil
@@ -225,22 +462,47 @@ func RawPacketBytes(src []byte) ([]byte, error) {
 // 0x5a -> 0x5a, 0x02
 // 0x5d -> 0x5e, 0x01
 // 0x5e -> 0x5e, 0x02
-func Escape(b []byte) (ret []byte) {
-	for i := 0; i < len(b); i++ {
-		switch b[i] {
+func Escape(b []byte) []byte {
+	return AppendEscape(nil, b)
+}
+
+// 把 b 转义后追加到 dst，dst 只扩容一次
+func AppendEscape(dst, b []byte) []byte {
+	n := len(b)
+	for _, c := range b {
+		switch c {
+		case BeginDelimiter, BeginEscapeChar, EndDelimiter, EndEscapeChar:
+			n++
+		}
+	}
+	l := len(dst)
+	if cap(dst)-l < n {
+		grown := make([]byte, l, l+n)
+		copy(grown, dst)
+		dst = grown
+	}
+	dst = dst[:l+n]
+	i := l
+	for _, c := range b {
+		switch c {
 		case BeginDelimiter:
-			ret = append(ret, 0x5a, 0x01)
+			dst[i], dst[i+1] = 0x5a, 0x01
+			i += 2
 		case BeginEscapeChar:
-			ret = append(ret, 0x5a, 0x02)
+			dst[i], dst[i+1] = 0x5a, 0x02
+			i += 2
 		case EndDelimiter:
-			ret = append(ret, 0x5e, 0x01)
+			dst[i], dst[i+1] = 0x5e, 0x01
+			i += 2
 		case EndEscapeChar:
-			ret = append(ret, 0x5e, 0x02)
+			dst[i], dst[i+1] = 0x5e, 0x02
+			i += 2
 		default:
-			ret = append(ret, b[i])
+			dst[i] = c
+			i++
 		}
 	}
-	return ret
+	return dst
 }
 
 // 反转义
@@ -305,6 +567,42 @@ func Encrypt(M1, IA1, IC1, key uint32, data []byte) {
 	}
 }
 
+// 手写 MarshalBytes/UnmarshalBytes 使用的读写函数，readUint16/readUint32 数据不足时返回 bytecodec.ErrShortData
+func writeUint16(cs *bytecodec.CodecState, v uint16) {
+	var b [2]byte
+	binary.BigEndian.PutUint16(b[:], v)
+	cs.Write(b[:])
+}
+
+func writeUint32(cs *bytecodec.CodecState, v uint32) {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], v)
+	cs.Write(b[:])
+}
+
+func readUint16(cs *bytecodec.CodecState) uint16 {
+	var b [2]byte
+	cs.ReadFull(b[:])
+	return binary.BigEndian.Uint16(b[:])
+}
+
+func readUint32(cs *bytecodec.CodecState) uint32 {
+	var b [4]byte
+	cs.ReadFull(b[:])
+	return binary.BigEndian.Uint32(b[:])
+}
+
+// 读取最多 n 字节，数据不足时不返回错误，只返回剩余的数据，没有数据时返回长度为 0 的 slice
+// 反射解码 length:n 的 []byte 字段时同样在数据结束时停止，TestUpExgMsgByteCoder 比较了两者对截断数据的结果
+func readBytes(cs *bytecodec.CodecState, n int) []byte {
+	if n > cs.Len() {
+		n = cs.Len()
+	}
+	b := make([]byte, n)
+	cs.ReadFull(b)
+	return b
+}
+
 func BinToBoolSlice(bin uint64) (ret []bool) {
 	for i := 0; i < 64; i++ {
 		var mask uint64 = 1 << i
@@ -2,9 +2,14 @@ package jt809
 
 import (
 	"bytes"
+	"encoding/binary"
 	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
 	"reflect"
 	"testing"
+	"time"
 )
 
 // 00000048 5B 000000 5A 703FE36E 5D 8010000010 5E 7D9CC4900C
@@ -61,3 +66,344 @@ func TestReadPacket(t *testing.T) {
 		t.Error("ReadPacket error", hex.EncodeToString(ret))
 	}
 }
+
+type countReader struct {
+	r     io.Reader
+	reads int
+}
+
+func (c *countReader) Read(b []byte) (int, error) {
+	c.reads++
+	return c.r.Read(b)
+}
+
+func TestFrameReader(t *testing.T) {
+	frame := mustHexDecodeString("5B000000480000008510010133EFB80100000100035D")
+	var stream []byte
+	stream = append(stream, 0x01, 0x5d, 0x02) // 头标识之前的数据
+	stream = append(stream, frame...)
+	stream = append(stream, 0x5b, 0x01, 0x02) // 没有尾标识，之后出现新的头标识
+	stream = append(stream, frame...)
+	stream = append(stream, bytes.Repeat([]byte{0x01}, 64)...) // 帧之间的数据
+	stream = append(stream, 0x5b)
+	stream = append(stream, bytes.Repeat([]byte{0x01}, 100)...) // 超过最大长度
+	stream = append(stream, 0x5d)
+	stream = append(stream, frame...)
+	stream = append(stream, 0x5b, 0x01, 0x02) // 连接结束时不完整的帧
+
+	cr := &countReader{r: bytes.NewReader(stream)}
+	r := NewFrameReader(cr, 64)
+	for i := 0; i < 2; i++ {
+		ret, err := r.ReadFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(ret, frame) {
+			t.Error("ReadFrame error", hex.EncodeToString(ret))
+		}
+	}
+	_, err := r.ReadFrame()
+	if e, ok := err.(*FrameTooLargeErr); !ok || e.Max != 64 {
+		t.Error("ReadFrame should return FrameTooLargeErr", err)
+	}
+	ret, err := r.ReadFrame()
+	if err != nil || !bytes.Equal(ret, frame) {
+		t.Error("ReadFrame should resync after oversized frame", hex.EncodeToString(ret), err)
+	}
+	_, err = r.ReadFrame()
+	if e, ok := err.(*TruncatedFrameErr); !ok || !errors.Is(e, io.ErrUnexpectedEOF) {
+		t.Error("ReadFrame should return TruncatedFrameErr", err)
+	}
+	_, err = r.ReadFrame()
+	if err != io.EOF {
+		t.Error("ReadFrame should return io.EOF", err)
+	}
+	if cr.reads > 3 {
+		t.Error("ReadFrame should not read byte by byte", cr.reads)
+	}
+
+	for _, short := range [][]byte{{}, {0x5b, 0x5d}, {0x5b, 0x01, 0x5d}, {0x5b, 0x5e, 0x01, 0x5d}} {
+		if _, err := RawPacketBytes(short); err == nil {
+			t.Error("RawPacketBytes should reject short frame", hex.EncodeToString(short))
+		}
+	}
+	if _, err := Unmarshal([]byte{0x5b, 0x5d}); err == nil {
+		t.Error("Unmarshal should reject short frame")
+	}
+}
+
+func TestEncryptParams(t *testing.T) {
+	params := EncryptParams{M1: 12345678, IA1: 87654321, IC1: 11223344}
+	p := NewUpConnectReq()
+	h := p.Header()
+	h.Encrypt = 1
+	h.EncryptKey = 809
+	p.UserID = 1
+	p.Password = FixedLengthString("1", 8, false)
+	p.DownLinkIP = FixedLengthString("127.0.0.1", 32, false)
+
+	data, err := Marshal(p, WithEncryptParams(params))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reflect.DeepEqual(data, mustMarshal(p)) {
+		t.Error("EncryptParams should change encrypted body")
+	}
+	ret, err := Unmarshal(data, WithEncryptParams(params))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(ret, p) {
+		t.Error("EncryptParams roundtrip error", p, ret)
+	}
+}
+
+func TestProtocol2019(t *testing.T) {
+	p := NewUpLinkTestReq()
+	h := p.Header()
+	h.SerialNo = 1
+	h.GNSSCenterID = 20180920
+	h.Version = Protocol2019.Version()
+	h.Time = 1600000000
+
+	data, err := Marshal(p, WithProtocol(Protocol2019))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Header().Length != 1+HeaderLength2019+1+2 {
+		t.Error("2019 header length error", p.Header().Length)
+	}
+	ret, err := Unmarshal(data, WithProtocol(Protocol2019))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(ret, p) {
+		t.Error("Protocol2019 roundtrip error", p, ret)
+	}
+
+	_, err = Marshal(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Header().Length != 1+HeaderLength+1+2 {
+		t.Error("2011 header should not include time", p.Header().Length)
+	}
+}
+
+func TestValidVersion(t *testing.T) {
+	cases := []struct {
+		protocol Protocol
+		version  []byte
+		valid    bool
+	}{
+		{Protocol2011, []byte{1, 0, 0}, true},
+		{Protocol2011, []byte{1, 1, 15}, true},
+		{Protocol2011, []byte{1, 2, 15}, false},
+		{Protocol2011, []byte{2, 0, 0}, false},
+		{Protocol2011, []byte{1, 0}, false},
+		{Protocol2019, []byte{1, 2, 0}, true},
+		{Protocol2019, []byte{1, 3, 0}, true},
+		{Protocol2019, []byte{1, 0, 0}, false},
+	}
+	for _, c := range cases {
+		err := c.protocol.ValidVersion(c.version)
+		if (err == nil) != c.valid {
+			t.Error("ValidVersion error", c.protocol, c.version, err)
+		}
+	}
+}
+
+func TestDecodeError(t *testing.T) {
+	badcrc := mustMarshal(NewUpLinkTestReq())
+	badcrc[len(badcrc)-2] ^= 0xff
+	// 子业务数据长度超过数据体
+	overflow := make([]byte, 21+1+2+4)
+	binary.BigEndian.PutUint16(overflow[22:], UP_EXG_MSG_REAL_LOCATION)
+	binary.BigEndian.PutUint32(overflow[24:], 100)
+	short := NewRawPacket(UP_EXG_MSG, overflow)
+	var stream []byte
+	stream = append(stream, badcrc...)
+	stream = append(stream, mustMarshal(short)...)
+	stream = append(stream, mustMarshal(NewUpLinkTestRsp())...)
+	stream = append(stream, 0x5b, 0x01)
+
+	dec := NewDecoder(bytes.NewReader(stream))
+	_, err := dec.Decode()
+	if e, ok := err.(*DecodeError); !ok || e.Kind != FrameError || !e.Recoverable() {
+		t.Error("CRC error should be FrameError", err)
+	} else if _, ok := e.Err.(*WrongCRC16CCITTError); !ok {
+		t.Error("CRC error should wrap WrongCRC16CCITTError", e.Err)
+	}
+	_, err = dec.Decode()
+	if e, ok := err.(*DecodeError); !ok || e.Kind != PacketError || e.Header.Type != UP_EXG_MSG {
+		t.Error("SubLength overflow should be PacketError", err)
+	}
+	p, err := dec.Decode()
+	if _, ok := p.(*UpLinkTestRsp); !ok || err != nil {
+		t.Error("Decode should continue after recoverable errors", p, err)
+	}
+	_, err = dec.Decode()
+	if e, ok := err.(*DecodeError); !ok || e.Kind != TransportError || e.Recoverable() {
+		t.Error("truncated frame at EOF should be TransportError", err)
+	}
+}
+
+// 修改帧内容之后重新计算校验码和转义
+func reframe(content []byte) []byte {
+	b := make([]byte, len(content)+2)
+	copy(b, content)
+	binary.BigEndian.PutUint16(b[len(content):], CRC16CCITTFalse.Checksum(content))
+	b = append([]byte{BeginDelimiter}, Escape(b)...)
+	return append(b, EndDelimiter)
+}
+
+func TestValidation(t *testing.T) {
+	valid := mustHexDecodeString("5B000000480000008510010133EFB8010000010003E8B2D37D9CC4900C77DC78F8676527D8AE12243CFB64CC2FBA619AEFAD33ACCB3256F67BFF19DF33097841098665703FE36E5D")
+
+	content, err := RawPacketBytes(mustMarshal(NewUpLinkTestReq()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	binary.BigEndian.PutUint32(content, 100)
+	wrongLength := reframe(content)
+
+	// 数据体缺少字节
+	short := NewUpLinkTestReq()
+	short.Header().Type = DOWN_CONNECT_REQ
+	// 数据体有多余的字节
+	trailing := NewRawPacket(UP_LINKTEST_REQ, []byte{0x01, 0x02})
+	// 子业务数据长度超过数据体
+	overflow := make([]byte, 21+1+2+4)
+	binary.BigEndian.PutUint16(overflow[22:], UP_EXG_MSG_REAL_LOCATION)
+	binary.BigEndian.PutUint32(overflow[24:], 100)
+
+	cases := []struct {
+		name    string
+		frame   []byte
+		strict  error
+		lenient error
+	}{
+		{"valid", valid, nil, nil},
+		{"valid sub packet", mustHexDecodeString("5B0000005A020000008512000133EFB8010000010003E8B234FBF83D930E75D07DC1555516EA993C1412CB4AFD2DA8639AEFAD17ACDF3E511377CE10DF3309034109861E736DE119CEBFFEF3AF0E8A6F9479A1AC36FC416960BD5D"), nil, nil},
+		{"wrong length", wrongLength, ErrLengthMismatch, nil},
+		{"short body", mustMarshal(short), ErrLengthMismatch, nil},
+		{"trailing bytes", mustMarshal(trailing), ErrLengthMismatch, nil},
+		{"sub length overflow", mustMarshal(NewRawPacket(UP_EXG_MSG, overflow)), ErrSubLengthOverflow, ErrSubLengthOverflow},
+	}
+	for _, c := range cases {
+		_, err := Unmarshal(c.frame, WithValidation(ValidateStrict))
+		if !errors.Is(err, c.strict) || (c.strict == nil && err != nil) {
+			t.Error(c.name, "strict error", err)
+		}
+		_, err = Unmarshal(c.frame)
+		if !errors.Is(err, c.lenient) || (c.lenient == nil && err != nil) {
+			t.Error(c.name, "lenient error", err)
+		}
+	}
+}
+
+func TestAppendPacket(t *testing.T) {
+	prefix := []byte{0x01, 0x02}
+	for _, p := range []Packet{NewUpLinkTestReq(), benchmarkLocation()} {
+		want := mustMarshal(p)
+		got, err := AppendPacket(append([]byte(nil), prefix...), p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got[:len(prefix)], prefix) || !bytes.Equal(got[len(prefix):], want) {
+			t.Errorf("AppendPacket error %x, should be %x", got, want)
+		}
+	}
+
+	// Encoder 复用缓冲区，连续编码的结果互不影响
+	buf := &bytes.Buffer{}
+	enc := NewEncoder(buf)
+	var want []byte
+	for _, p := range []Packet{benchmarkLocation(), NewUpLinkTestReq(), benchmarkLocation()} {
+		if err := enc.Encode(p); err != nil {
+			t.Fatal(err)
+		}
+		want = append(want, mustMarshal(p)...)
+	}
+	if !bytes.Equal(buf.Bytes(), want) {
+		t.Errorf("Encoder error %x, should be %x", buf.Bytes(), want)
+	}
+}
+
+func TestAppendEscape(t *testing.T) {
+	unescaped := mustHexDecodeString("000000485B0000005A703FE36E5D80100000105E7D9CC4900C")
+	dst := make([]byte, 1, 64)
+	ret := AppendEscape(dst, unescaped)
+	if &ret[0] != &dst[0] {
+		t.Error("AppendEscape should not grow dst with enough capacity")
+	}
+	if !bytes.Equal(ret[1:], Escape(unescaped)) {
+		t.Error("AppendEscape error", hex.EncodeToString(ret))
+	}
+}
+
+func benchmarkLocation() *UpExgMsg {
+	p := NewUpExgMsg()
+	h := p.Header()
+	h.Encrypt = 1
+	h.EncryptKey = 256178
+	h.GNSSCenterID = 20180920
+	p.VehicleNo = FixedLengthString("A12345", 21, true)
+	p.VehicleColor = PlateColorYellow
+	loc := NewUpExgMsgRealLocation()
+	gnsstime := time.Date(2021, 12, 20, 12, 49, 9, 0, time.UTC)
+	loc.Date = GNSSDataDate(gnsstime)
+	loc.Time = GNSSDataTime(gnsstime)
+	loc.Lon = 116397128
+	loc.Lat = 39916527
+	loc.Vec1 = 60
+	loc.State = &LocationStatus{ACC: true, Location: true}
+	p.SetSubPacket(loc)
+	return p
+}
+
+func BenchmarkMarshal(b *testing.B) {
+	p := benchmarkLocation()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := Marshal(p); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkAppendPacket(b *testing.B) {
+	p := benchmarkLocation()
+	enc := NewEncoder(ioutil.Discard)
+	var buf []byte
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		var err error
+		buf, err = enc.Append(buf[:0], p)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.SetBytes(int64(len(buf)))
+}
+
+func BenchmarkEncoder(b *testing.B) {
+	p := benchmarkLocation()
+	enc := NewEncoder(ioutil.Discard)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if err := enc.Encode(p); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkEscape(b *testing.B) {
+	src := mustMarshal(benchmarkLocation())
+	src = src[1 : len(src)-1]
+	dst := make([]byte, 0, 2*len(src))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		dst = AppendEscape(dst[:0], src)
+	}
+}
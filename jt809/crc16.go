@@ -0,0 +1,82 @@
+package jt809
+
+// CRC16 校验算法，参数的含义和 CRC 参数目录（Rocksoft 模型）一致
+// 标准规定使用 CRC-16/CCITT-FALSE：多项式 0x1021，初始值 0xFFFF，输入输出不反转，结果不异或
+// 对接不符合标准的平台时可以使用其他变体
+type CRC16 struct {
+	Name    string
+	Poly    uint16
+	Init    uint16
+	Reflect bool // 输入和输出是否按位反转
+	XorOut  uint16
+
+	table [256]uint16
+}
+
+func NewCRC16(name string, poly, init uint16, reflect bool, xorout uint16) *CRC16 {
+	c := &CRC16{Name: name, Poly: poly, Init: init, Reflect: reflect, XorOut: xorout}
+	if reflect {
+		rpoly := reverse16(poly)
+		for i := range c.table {
+			crc := uint16(i)
+			for j := 0; j < 8; j++ {
+				if crc&1 == 1 {
+					crc = crc>>1 ^ rpoly
+				} else {
+					crc >>= 1
+				}
+			}
+			c.table[i] = crc
+		}
+		return c
+	}
+	for i := range c.table {
+		crc := uint16(i) << 8
+		for j := 0; j < 8; j++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ poly
+			} else {
+				crc <<= 1
+			}
+		}
+		c.table[i] = crc
+	}
+	return c
+}
+
+func reverse16(v uint16) (ret uint16) {
+	for i := 0; i < 16; i++ {
+		ret = ret<<1 | v&1
+		v >>= 1
+	}
+	return ret
+}
+
+func (c *CRC16) Checksum(data []byte) uint16 {
+	crc := c.Init
+	if c.Reflect {
+		crc = reverse16(crc)
+		for _, b := range data {
+			crc = crc>>8 ^ c.table[byte(crc)^b]
+		}
+	} else {
+		for _, b := range data {
+			crc = crc<<8 ^ c.table[byte(crc>>8)^b]
+		}
+	}
+	return crc ^ c.XorOut
+}
+
+func (c *CRC16) String() string {
+	return c.Name
+}
+
+var (
+	// 标准规定的校验算法，默认使用
+	CRC16CCITTFalse = NewCRC16("CRC-16/CCITT-FALSE", 0x1021, 0xffff, false, 0)
+	// 初始值为 0 的 CCITT
+	CRC16XModem = NewCRC16("CRC-16/XMODEM", 0x1021, 0, false, 0)
+	// 反转输入输出的 CCITT，早期版本的解码校验使用这个算法
+	CRC16X25    = NewCRC16("CRC-16/X-25", 0x1021, 0xffff, true, 0xffff)
+	CRC16Kermit = NewCRC16("CRC-16/KERMIT", 0x1021, 0, true, 0)
+)
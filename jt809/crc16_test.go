@@ -0,0 +1,59 @@
+package jt809
+
+import (
+	"testing"
+)
+
+// 各变体对 "123456789" 的校验值，来自 CRC 参数目录
+func TestCRC16Check(t *testing.T) {
+	cases := []struct {
+		crc   *CRC16
+		check uint16
+	}{
+		{CRC16CCITTFalse, 0x29b1},
+		{CRC16XModem, 0x31c3},
+		{CRC16X25, 0x906e},
+		{CRC16Kermit, 0x2189},
+	}
+	for _, c := range cases {
+		if sum := c.crc.Checksum([]byte("123456789")); sum != c.check {
+			t.Errorf("%s check %#04x should be %#04x", c.crc, sum, c.check)
+		}
+	}
+}
+
+// 报文来自本包 packet_test.go 和 codec_test.go 中已有的用例，校验码按 CRC-16/CCITT-FALSE 计算
+// 不是标准文档中的示例报文：docs 中的标准文档是扫描图片，没有可以提取的文字，示例报文没有转录
+func TestCRC16GoldenFrames(t *testing.T) {
+	frames := []string{
+		"5B000000480000008510010133EFB8010000010003E8B2D37D9CC4900C77DC78F8676527D8AE12243CFB64CC2FBA619AEFAD33ACCB3256F67BFF19DF33097841098665703FE36E5D",
+		"5B0000005A020000008512000133EFB8010000010003E8B234FBF83D930E75D07DC1555516EA993C1412CB4AFD2DA8639AEFAD17ACDF3E511377CE10DF3309034109861E736DE119CEBFFEF3AF0E8A6F9479A1AC36FC416960BD5D",
+	}
+	for _, frame := range frames {
+		src := mustHexDecodeString(frame)
+		if _, err := RawPacketBytes(src); err != nil {
+			t.Error("golden frame CRC error", err)
+		}
+		if _, err := rawPacketBytes(src, CRC16X25); err == nil {
+			t.Error("golden frame should fail with CRC-16/X-25", frame)
+		}
+	}
+}
+
+func TestWithCRC16(t *testing.T) {
+	p := NewUpLinkTestReq()
+	data, err := Marshal(p, WithCRC16(CRC16XModem))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Unmarshal(data); err == nil {
+		t.Error("default CRC should reject CRC-16/XMODEM frame")
+	}
+	ret, err := Unmarshal(data, WithCRC16(CRC16XModem))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := ret.(*UpLinkTestReq); !ok {
+		t.Error("WithCRC16 roundtrip error", ret)
+	}
+}
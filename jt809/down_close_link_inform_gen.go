@@ -0,0 +1,35 @@
+// Code generated by genpacket from packets_schema.go. DO NOT EDIT.
+
+package jt809
+
+import "fmt"
+
+// 上级平台主动关闭链路通知消息
+// 链路类型：主链路。
+// 消息方向：上级平台往下级平台。
+// 业务数据类型标识：DOWN_CLOSELINK_INFORM.
+// 描述：上级平台作为服务端，发现主链路出现异常时，上级平台通过主链路向下级平台发送本消息，通知下级平台上级平台即将关闭主从链路。
+type DownCloseLinkInform struct {
+	*headerSetter
+	ReasonCode byte // 链路关闭原因 0x00:网关重启 0x01:其他原因
+}
+
+func NewDownCloseLinkInform() *DownCloseLinkInform {
+	p := &DownCloseLinkInform{}
+	p.headerSetter = newHeaderSeter(DOWN_CLOSELINK_INFORM)
+	return p
+}
+
+func (p DownCloseLinkInform) LinkType() LinkType {
+	return UpLinkOnly
+}
+
+func (p DownCloseLinkInform) String() string {
+	return fmt.Sprintf("DownCloseLinkInform{Header:%s, ReasonCode:%d}", p.Header(), p.ReasonCode)
+}
+
+func init() {
+	if err := RegisterPacket(DOWN_CLOSELINK_INFORM, func() Packet { return NewDownCloseLinkInform() }); err != nil {
+		panic(err)
+	}
+}
@@ -12,6 +12,14 @@ type DownConnectRsp struct {
 	Result byte // 0x00:成功； 0x01: VERIFY_CODE错误；0x02:资源紧张，稍后再连接（已经占用）；0x03:其他
 }
 
+// 从链路连接应答的验证结果
+const (
+	DownConnectSuccess         byte = 0x00 // 成功
+	DownConnectVerifyCodeError byte = 0x01 // VERIFY_CODE错误
+	DownConnectBusy            byte = 0x02 // 资源紧张，稍后再连接（已经占用）
+	DownConnectOther           byte = 0x03 // 其他
+)
+
 func NewDownConnectRsp() *DownConnectRsp {
 	p := &DownConnectRsp{}
 	p.headerSetter = newHeaderSeter(DOWN_CONNECT_RSP)
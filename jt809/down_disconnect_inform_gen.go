@@ -0,0 +1,36 @@
+// Code generated by genpacket from packets_schema.go. DO NOT EDIT.
+
+package jt809
+
+import "fmt"
+
+// 从链路断开通知消息
+// 链路类型：主链路。
+// 消息方向：上级平台往下级平台。
+// 业务数据类型标识：DOWN_DISCONNECT_INFORM.
+// 描述：情景1：上级平台与下级平台的从链路中断后，重连三次仍未成功，上级平台通过主链路发送本消息给下级平台。
+// 情景2：上级平台作为客户端向下级平台登录时，根据之前收到的 IP 地址及端口无法连接到下级平台服务端时发送本消息通知下级平台。
+type DownDisconnectInform struct {
+	*headerSetter
+	ErrorCode byte // 错误代码 0x00:无法连接下级平台指定的服务 IP 与端口 0x01:上级平台客户端与下级平台服务端断开 0x02:其他原因
+}
+
+func NewDownDisconnectInform() *DownDisconnectInform {
+	p := &DownDisconnectInform{}
+	p.headerSetter = newHeaderSeter(DOWN_DISCONNECT_INFORM)
+	return p
+}
+
+func (p DownDisconnectInform) LinkType() LinkType {
+	return UpLinkOnly
+}
+
+func (p DownDisconnectInform) String() string {
+	return fmt.Sprintf("DownDisconnectInform{Header:%s, ErrorCode:%d}", p.Header(), p.ErrorCode)
+}
+
+func init() {
+	if err := RegisterPacket(DOWN_DISCONNECT_INFORM, func() Packet { return NewDownDisconnectInform() }); err != nil {
+		panic(err)
+	}
+}
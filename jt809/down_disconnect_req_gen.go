@@ -0,0 +1,35 @@
+// Code generated by genpacket from packets_schema.go. DO NOT EDIT.
+
+package jt809
+
+import "fmt"
+
+// 从链路注销请求消息
+// 链路类型：从链路。
+// 消息方向：上级平台往下级平台。
+// 业务数据类型标识：DOWN_DISCONNECT_REQ.
+// 描述：从链路建立以后，上级平台在取消该链路时，应向下级平台发送从链路注销请求消息。
+type DownDisconnectReq struct {
+	*headerSetter
+	VerifyCode uint32 // 主链路登录应答的校验码
+}
+
+func NewDownDisconnectReq() *DownDisconnectReq {
+	p := &DownDisconnectReq{}
+	p.headerSetter = newHeaderSeter(DOWN_DISCONNECT_REQ)
+	return p
+}
+
+func (p DownDisconnectReq) LinkType() LinkType {
+	return DownLinkOnly
+}
+
+func (p DownDisconnectReq) String() string {
+	return fmt.Sprintf("DownDisconnectReq{Header:%s, VerifyCode:%d}", p.Header(), p.VerifyCode)
+}
+
+func init() {
+	if err := RegisterPacket(DOWN_DISCONNECT_REQ, func() Packet { return NewDownDisconnectReq() }); err != nil {
+		panic(err)
+	}
+}
@@ -0,0 +1,35 @@
+// Code generated by genpacket from packets_schema.go. DO NOT EDIT.
+
+package jt809
+
+import "fmt"
+
+// 从链路注销应答消息
+// 链路类型：从链路。
+// 消息方向：下级平台往上级平台。
+// 业务数据类型标识：DOWN_DISCONNECT_RSP.
+// 描述：下级平台在收到上级平台发送的从链路注销请求消息以后，返回从链路注销应答消息，记录相关日志，中断该从链路。
+// 从链路注销应答消息，数据体为空。
+type DownDisconnectRsp struct {
+	*headerSetter
+}
+
+func NewDownDisconnectRsp() *DownDisconnectRsp {
+	p := &DownDisconnectRsp{}
+	p.headerSetter = newHeaderSeter(DOWN_DISCONNECT_RSP)
+	return p
+}
+
+func (p DownDisconnectRsp) LinkType() LinkType {
+	return DownLinkOnly
+}
+
+func (p DownDisconnectRsp) String() string {
+	return fmt.Sprintf("DownDisconnectRsp{Header:%s}", p.Header())
+}
+
+func init() {
+	if err := RegisterPacket(DOWN_DISCONNECT_RSP, func() Packet { return NewDownDisconnectRsp() }); err != nil {
+		panic(err)
+	}
+}
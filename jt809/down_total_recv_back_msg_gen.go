@@ -0,0 +1,37 @@
+// Code generated by genpacket from packets_schema.go. DO NOT EDIT.
+
+package jt809
+
+import "fmt"
+
+// 接收定位信息数量通知消息
+// 链路类型：从链路。
+// 消息方向：上级平台往下级平台。
+// 业务数据类型标识：DOWN_TOTAL_RECV_BACK_MSG.
+// 描述：上级平台向下级平台定量通知已经收到下级平台上传的车辆定位信息数量（如：每收到 10000 条车辆定位信息通知一次）。
+type DownTotalRecvBackMsg struct {
+	*headerSetter
+	DynamicInfoTotal uint32 // START_TIME~END_TIME 共收到的车辆定位信息数量
+	StartTime        uint64 // 开始时间，用 UTC 时间表示
+	EndTime          uint64 // 结束时间，用 UTC 时间表示
+}
+
+func NewDownTotalRecvBackMsg() *DownTotalRecvBackMsg {
+	p := &DownTotalRecvBackMsg{}
+	p.headerSetter = newHeaderSeter(DOWN_TOTAL_RECV_BACK_MSG)
+	return p
+}
+
+func (p DownTotalRecvBackMsg) LinkType() LinkType {
+	return DownLinkOnly
+}
+
+func (p DownTotalRecvBackMsg) String() string {
+	return fmt.Sprintf("DownTotalRecvBackMsg{Header:%s, DynamicInfoTotal:%d, StartTime:%d, EndTime:%d}", p.Header(), p.DynamicInfoTotal, p.StartTime, p.EndTime)
+}
+
+func init() {
+	if err := RegisterPacket(DOWN_TOTAL_RECV_BACK_MSG, func() Packet { return NewDownTotalRecvBackMsg() }); err != nil {
+		panic(err)
+	}
+}
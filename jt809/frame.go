@@ -0,0 +1,94 @@
+package jt809
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+)
+
+// 默认的最大帧长度，包括头尾标识和转义字符
+const DefaultMaxFrameSize = 1 << 20
+
+// 帧长度超过限制，超出的部分会在读取下一帧时丢弃
+type FrameTooLargeErr struct {
+	Size int
+	Max  int
+}
+
+func (e *FrameTooLargeErr) Error() string {
+	return fmt.Sprintf("jt809 frame too large %d > %d", e.Size, e.Max)
+}
+
+// 帧不完整，Err 为 io.ErrUnexpectedEOF 时表示读取到尾标识之前连接已经结束
+type TruncatedFrameErr struct {
+	Size int
+	Err  error
+}
+
+func (e *TruncatedFrameErr) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("jt809 truncated frame %d bytes: %s", e.Size, e.Err)
+	}
+	return fmt.Sprintf("jt809 truncated frame %d bytes", e.Size)
+}
+
+func (e *TruncatedFrameErr) Unwrap() error {
+	return e.Err
+}
+
+// 从数据流中读取完整的帧
+// 丢弃头标识之前的数据，帧中出现头标识时丢弃之前读取的部分，从新的头标识重新开始
+type FrameReader struct {
+	r   *bufio.Reader
+	max int
+}
+
+// maxFrameSize 小于等于 0 时使用 DefaultMaxFrameSize
+func NewFrameReader(r io.Reader, maxFrameSize int) *FrameReader {
+	if maxFrameSize <= 0 {
+		maxFrameSize = DefaultMaxFrameSize
+	}
+	br, ok := r.(*bufio.Reader)
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+	return &FrameReader{r: br, max: maxFrameSize}
+}
+
+// 返回包括头尾标识的帧，返回的 slice 不会被之后的读取修改
+// 连接在帧之间结束时返回 io.EOF
+func (f *FrameReader) ReadFrame() ([]byte, error) {
+	// 丢弃头标识之前的数据
+	for {
+		_, err := f.r.ReadSlice(BeginDelimiter)
+		if err == nil {
+			break
+		}
+		if err != bufio.ErrBufferFull {
+			return nil, err
+		}
+	}
+
+	frame := []byte{BeginDelimiter}
+	for {
+		chunk, err := f.r.ReadSlice(EndDelimiter)
+		if i := bytes.LastIndexByte(chunk, BeginDelimiter); i >= 0 {
+			frame = frame[:0]
+			chunk = chunk[i:]
+		}
+		frame = append(frame, chunk...)
+		if len(frame) > f.max {
+			return nil, &FrameTooLargeErr{Size: len(frame), Max: f.max}
+		}
+		if err == nil {
+			return frame, nil
+		}
+		if err == io.EOF {
+			return nil, &TruncatedFrameErr{Size: len(frame), Err: io.ErrUnexpectedEOF}
+		}
+		if err != bufio.ErrBufferFull {
+			return nil, err
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package jt809
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"time"
+)
+
+// 定位数据中的日期和时间使用北京时间 UTC+8
+var BeijingTime = time.FixedZone("CST", 8*60*60)
+
+// 卫星定位数据，实时定位、定位补报消息中 GNSS_DATA 的类型化表示
+// 通过 UpExgMsgRealLocation 的 SetGNSSData 和 GNSSData 与报文中的格式互相转换
+// 车辆定位信息交换、车辆拍照应答等消息中的 GNSS_DATA 格式相同，但这些消息还没有定义，暂不提供转换
+type GNSSData struct {
+	Encrypted     bool      // 经纬度是否已经过保密插件加密
+	Time          time.Time // 定位时间，精确到秒，编码时转换为北京时间，解码后的时区是 BeijingTime
+	Lon           float64   // 经度，单位为度，西经为负数
+	Lat           float64   // 纬度，单位为度，南纬为负数
+	Speed         float64   // 卫星定位速度，单位为千米每小时(km/h)，编码时四舍五入为整数
+	RecorderSpeed float64   // 行驶记录速度，单位为千米每小时(km/h)，编码时四舍五入为整数
+	Mileage       float64   // 车辆当前总里程数，单位为千米(km)，编码时四舍五入为整数
+	Direction     uint16    // 方向，0~359，单位为度，正北为 0，顺时针
+	Altitude      uint16    // 海拔高度，单位为米(m)
+	// 车辆状态，LatitudeSouth、LongitudeWest 由经纬度的符号决定
+	Status LocationStatus
+	Alarm  LocationAlarm
+}
+
+// 定位数据超出范围，或者报文中的日期时间无效
+type InvalidGNSSDataErr struct {
+	Field string
+	Value interface{}
+}
+
+func (e *InvalidGNSSDataErr) Error() string {
+	return fmt.Sprintf("jt809 invalid GNSS data %s: %v", e.Field, e.Value)
+}
+
+// 检查纬度 ±90、经度 ±180、方向 0~359 以及速度、里程不超过报文字段的范围
+func (d GNSSData) Validate() error {
+	switch {
+	case d.Time.IsZero():
+		return &InvalidGNSSDataErr{Field: "Time", Value: d.Time}
+	case !(d.Lat >= -90 && d.Lat <= 90):
+		return &InvalidGNSSDataErr{Field: "Lat", Value: d.Lat}
+	case !(d.Lon >= -180 && d.Lon <= 180):
+		return &InvalidGNSSDataErr{Field: "Lon", Value: d.Lon}
+	case d.Direction > 359:
+		return &InvalidGNSSDataErr{Field: "Direction", Value: d.Direction}
+	case !(d.Speed >= 0 && d.Speed <= math.MaxUint16):
+		return &InvalidGNSSDataErr{Field: "Speed", Value: d.Speed}
+	case !(d.RecorderSpeed >= 0 && d.RecorderSpeed <= math.MaxUint16):
+		return &InvalidGNSSDataErr{Field: "RecorderSpeed", Value: d.RecorderSpeed}
+	case !(d.Mileage >= 0 && d.Mileage <= math.MaxUint32):
+		return &InvalidGNSSDataErr{Field: "Mileage", Value: d.Mileage}
+	}
+	return nil
+}
+
+// 解析 GNSSDataDate 和 GNSSDataTime 编码的日期和时间，loc 为空时使用 BeijingTime
+func ParseGNSSDataTime(date, clock []byte, loc *time.Location) (time.Time, error) {
+	if loc == nil {
+		loc = BeijingTime
+	}
+	if len(date) != 4 {
+		return time.Time{}, &InvalidGNSSDataErr{Field: "Date", Value: date}
+	}
+	if len(clock) != 3 {
+		return time.Time{}, &InvalidGNSSDataErr{Field: "Time", Value: clock}
+	}
+	day, month, year := int(date[0]), time.Month(date[1]), int(binary.BigEndian.Uint16(date[2:]))
+	hour, min, sec := int(clock[0]), int(clock[1]), int(clock[2])
+	t := time.Date(year, month, day, hour, min, sec, 0, loc)
+	// time.Date 会把超出范围的值进位，例如 2 月 30 日变成 3 月 2 日
+	if t.Day() != day || t.Month() != month || t.Year() != year || t.Hour() != hour || t.Minute() != min || t.Second() != sec {
+		return time.Time{}, &InvalidGNSSDataErr{Field: "Date", Value: fmt.Sprintf("%#x %#x", date, clock)}
+	}
+	return t, nil
+}
+
+func microDegrees(deg float64) uint32 {
+	return uint32(math.Round(math.Abs(deg) * 1e6))
+}
+
+func roundUint16(v float64) uint16 {
+	return uint16(math.Min(math.Round(v), math.MaxUint16))
+}
+
+// 把定位数据写入报文格式，数据超出范围时返回 *InvalidGNSSDataErr 且不修改 p
+func (p *UpExgMsgRealLocation) SetGNSSData(d GNSSData) error {
+	if err := d.Validate(); err != nil {
+		return err
+	}
+	t := d.Time.In(BeijingTime)
+	status := d.Status
+	status.LatitudeSouth = d.Lat < 0
+	status.LongitudeWest = d.Lon < 0
+	alarm := d.Alarm
+
+	p.Encrypt = 0
+	if d.Encrypted {
+		p.Encrypt = 1
+	}
+	p.Date = GNSSDataDate(t)
+	p.Time = GNSSDataTime(t)
+	p.Lon = microDegrees(d.Lon)
+	p.Lat = microDegrees(d.Lat)
+	p.Vec1 = roundUint16(d.Speed)
+	p.Vec2 = roundUint16(d.RecorderSpeed)
+	p.Vec3 = uint32(math.Min(math.Round(d.Mileage), math.MaxUint32))
+	p.Direction = d.Direction
+	p.Altitude = d.Altitude
+	p.State = &status
+	p.Alarm = &alarm
+	return nil
+}
+
+// 从报文格式转换为定位数据，日期时间无效或者经纬度超出范围时返回 *InvalidGNSSDataErr
+func (p *UpExgMsgRealLocation) GNSSData() (GNSSData, error) {
+	t, err := ParseGNSSDataTime(p.Date, p.Time, BeijingTime)
+	if err != nil {
+		return GNSSData{}, err
+	}
+	d := GNSSData{
+		Encrypted:     p.Encrypt == 1,
+		Time:          t,
+		Lon:           float64(p.Lon) / 1e6,
+		Lat:           float64(p.Lat) / 1e6,
+		Speed:         float64(p.Vec1),
+		RecorderSpeed: float64(p.Vec2),
+		Mileage:       float64(p.Vec3),
+		Direction:     p.Direction,
+		Altitude:      p.Altitude,
+	}
+	if p.State != nil {
+		d.Status = *p.State
+	}
+	if p.Alarm != nil {
+		d.Alarm = *p.Alarm
+	}
+	if d.Status.LongitudeWest {
+		d.Lon = -d.Lon
+	}
+	if d.Status.LatitudeSouth {
+		d.Lat = -d.Lat
+	}
+	if err := d.Validate(); err != nil {
+		return GNSSData{}, err
+	}
+	return d, nil
+}
+
+// 添加一条定位数据，同时更新 GNSSCount
+func (p *UpExgMsgHistoryLocation) AddGNSSData(d GNSSData) error {
+	loc := NewUpExgMsgRealLocation()
+	if err := loc.SetGNSSData(d); err != nil {
+		return err
+	}
+	p.Add(loc)
+	return nil
+}
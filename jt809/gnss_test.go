@@ -0,0 +1,120 @@
+package jt809
+
+import (
+	"bytes"
+	"errors"
+	"math"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseGNSSDataTime(t *testing.T) {
+	gnsstime := time.Date(2021, 12, 20, 12, 49, 9, 0, BeijingTime)
+	ret, err := ParseGNSSDataTime(GNSSDataDate(gnsstime), GNSSDataTime(gnsstime), nil)
+	if err != nil || !ret.Equal(gnsstime) || ret.Location() != BeijingTime {
+		t.Error("ParseGNSSDataTime error", ret, err)
+	}
+
+	for _, c := range []struct {
+		date, clock []byte
+	}{
+		{[]byte{30, 2, 0x07, 0xe5}, []byte{0, 0, 0}},
+		{[]byte{1, 13, 0x07, 0xe5}, []byte{0, 0, 0}},
+		{[]byte{1, 1, 0x07, 0xe5}, []byte{24, 0, 0}},
+		{[]byte{1, 1, 0x07}, []byte{0, 0, 0}},
+		{[]byte{1, 1, 0x07, 0xe5}, nil},
+	} {
+		_, err := ParseGNSSDataTime(c.date, c.clock, nil)
+		var gerr *InvalidGNSSDataErr
+		if !errors.As(err, &gerr) {
+			t.Errorf("ParseGNSSDataTime %x %x should return *InvalidGNSSDataErr, got %v", c.date, c.clock, err)
+		}
+	}
+}
+
+func TestGNSSData(t *testing.T) {
+	d := GNSSData{
+		Time:          time.Date(2021, 12, 20, 4, 49, 9, 0, time.UTC),
+		Lon:           -116.397128,
+		Lat:           -39.916527,
+		Speed:         60.4,
+		RecorderSpeed: 58.5,
+		Mileage:       123456.7,
+		Direction:     359,
+		Altitude:      44,
+		Status:        LocationStatus{ACC: true, Location: true},
+		Alarm:         LocationAlarm{Speeding: true},
+	}
+	loc := NewUpExgMsgRealLocation()
+	if err := loc.SetGNSSData(d); err != nil {
+		t.Fatal(err)
+	}
+
+	// 报文中使用北京时间，经纬度为绝对值，方向由状态位表示
+	if !bytes.Equal(loc.Date, []byte{20, 12, 0x07, 0xe5}) || !bytes.Equal(loc.Time, []byte{12, 49, 9}) {
+		t.Errorf("SetGNSSData time error %x %x", loc.Date, loc.Time)
+	}
+	if loc.Lon != 116397128 || loc.Lat != 39916527 || !loc.State.LongitudeWest || !loc.State.LatitudeSouth {
+		t.Error("SetGNSSData coordinate error", loc)
+	}
+	if loc.Vec1 != 60 || loc.Vec2 != 59 || loc.Vec3 != 123457 {
+		t.Error("SetGNSSData speed error", loc)
+	}
+
+	// 经过报文编码后再转换回来
+	p := NewUpExgMsg()
+	p.VehicleNo = FixedLengthString("A12345", 21, true)
+	p.SetSubPacket(loc)
+	decoded := mustUnmarshal(mustMarshal(p)).(*UpExgMsg).SubPacket().(*UpExgMsgRealLocation)
+	ret, err := decoded.GNSSData()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ret.Time.Equal(d.Time) || ret.Time.Location() != BeijingTime {
+		t.Error("GNSSData time error", ret.Time)
+	}
+	if math.Abs(ret.Lon-d.Lon) > 1e-6 || math.Abs(ret.Lat-d.Lat) > 1e-6 {
+		t.Error("GNSSData coordinate error", ret.Lon, ret.Lat)
+	}
+	want := d
+	want.Time, want.Lon, want.Lat = ret.Time, ret.Lon, ret.Lat
+	want.Speed, want.RecorderSpeed, want.Mileage = 60, 59, 123457
+	want.Status.LongitudeWest, want.Status.LatitudeSouth = true, true
+	if !reflect.DeepEqual(ret, want) {
+		t.Errorf("GNSSData error %+v, should be %+v", ret, want)
+	}
+
+	history := NewUpExgMsgHistoryLocation()
+	if err := history.AddGNSSData(d); err != nil || history.GNSSCount != 1 || !reflect.DeepEqual(history.GNSSData[0], *loc) {
+		t.Error("AddGNSSData error", history, err)
+	}
+}
+
+func TestGNSSDataValidate(t *testing.T) {
+	valid := GNSSData{Time: time.Now(), Lon: 180, Lat: -90, Direction: 359}
+	if err := valid.Validate(); err != nil {
+		t.Error(err)
+	}
+	for field, modify := range map[string]func(*GNSSData){
+		"Time":          func(d *GNSSData) { d.Time = time.Time{} },
+		"Lat":           func(d *GNSSData) { d.Lat = 90.000001 },
+		"Lon":           func(d *GNSSData) { d.Lon = math.NaN() },
+		"Direction":     func(d *GNSSData) { d.Direction = 360 },
+		"Speed":         func(d *GNSSData) { d.Speed = -1 },
+		"RecorderSpeed": func(d *GNSSData) { d.RecorderSpeed = 65536 },
+		"Mileage":       func(d *GNSSData) { d.Mileage = math.Inf(1) },
+	} {
+		d := valid
+		modify(&d)
+		loc := NewUpExgMsgRealLocation()
+		err := loc.SetGNSSData(d)
+		var gerr *InvalidGNSSDataErr
+		if !errors.As(err, &gerr) || gerr.Field != field {
+			t.Errorf("%s should be invalid, got %v", field, err)
+		}
+		if loc.Date != nil {
+			t.Errorf("%s invalid SetGNSSData should not modify packet", field)
+		}
+	}
+}
@@ -0,0 +1,514 @@
+// genpacket 根据消息定义文件生成数据包的结构、构造函数、LinkType、String、注册和往返测试
+//
+// 在 jt809 目录下运行 go generate，或者
+//
+//	go run ./internal/genpacket -schema packets_schema.go
+//
+// 消息定义是一个不参与编译的 Go 文件，每个消息是一个带指令注释的结构：
+//
+//	// 从链路注销请求消息
+//	// 描述：上级平台在中断从链路时，向下级平台发送从链路注销请求消息。
+//	//
+//	//jt809:packet type=DOWN_DISCONNECT_REQ link=DownLinkOnly dir=down
+//	type DownDisconnectReq struct {
+//		VerifyCode uint32 // 校验码
+//	}
+//
+// 指令 jt809:packet 定义业务数据类型，jt809:subpacket 定义子业务类型，参数：
+//
+//	type  类型常量的名称
+//	id    类型的值，设置后同时生成类型常量，常量已经在 packet.go 中定义时不设置
+//	link  数据包的 LinkType，只用于 jt809:packet
+//	dir   消息方向，up 是下级平台往上级平台，down 是上级平台往下级平台
+//	main  所属的业务数据类型常量，只用于 jt809:subpacket
+//
+// 第一行注释是消息名称，其余的注释是描述，字段的类型、tag 和注释原样复制到生成的结构中
+// 字段支持 byte、uint16、uint32、uint64、[]byte 和 string，长度和编码使用 bytecodec 的 tag
+// 每个消息生成一个 <消息名>_gen.go，所有消息的往返测试生成在 packets_gen_test.go
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"unicode"
+)
+
+const directivePrefix = "//jt809:"
+
+var linkTypes = map[string]string{
+	"UpLink":       "主链路",
+	"UpLinkOnly":   "主链路",
+	"DownLink":     "从链路",
+	"DownLinkOnly": "从链路",
+}
+
+var directions = map[string]string{
+	"up":   "下级平台往上级平台",
+	"down": "上级平台往下级平台",
+}
+
+type field struct {
+	Name    string
+	Type    string
+	Tag     string
+	Comment string
+	Length  int // bytecodec 的 length 或者 bcd8421 长度，没有设置时为 -1
+	BCD     bool
+}
+
+type message struct {
+	Name  string
+	Sub   bool
+	Type  string
+	ID    string
+	Link  string
+	Dir   string
+	Main  string
+	Title string
+	Desc  []string
+	Field []field
+
+	// String 方法的格式和参数
+	StringFormat string
+	StringArgs   string
+}
+
+func (m message) FileName() string {
+	return snakeCase(m.Name) + "_gen.go"
+}
+
+func (m message) LinkName() string {
+	return linkTypes[m.Link]
+}
+
+func (m message) DirName() string {
+	return directions[m.Dir]
+}
+
+func (m message) stringFormat() (string, string) {
+	var (
+		format []string
+		args   []string
+	)
+	if !m.Sub {
+		format = append(format, "Header:%s")
+		args = append(args, "p.Header()")
+	}
+	for _, f := range m.Field {
+		verb := "%d"
+		switch f.Type {
+		case "[]byte":
+			verb = "%x"
+		case "string":
+			verb = "%s"
+		}
+		format = append(format, f.Name+":"+verb)
+		args = append(args, "p."+f.Name)
+	}
+	return m.Name + "{" + strings.Join(format, ", ") + "}", strings.Join(args, ", ")
+}
+
+// 往返测试中字段的值，第 i 个字段使用 i 区分
+func (f field) TestValue(i int) (string, error) {
+	switch f.Type {
+	case "byte", "uint8":
+		return strconv.Itoa(i), nil
+	case "uint16":
+		return fmt.Sprintf("0x%02x%02x", i, i), nil
+	case "uint32":
+		return fmt.Sprintf("0x%02x%02x%02x%02x", i, i, i, i), nil
+	case "uint64":
+		return fmt.Sprintf("0x%02x%02x%02x%02x%02x%02x%02x%02x", i, i, i, i, i, i, i, i), nil
+	case "[]byte":
+		n := f.Length
+		if n < 0 {
+			n = 3
+		}
+		return fmt.Sprintf("bytes.Repeat([]byte{%d}, %d)", i, n), nil
+	case "string":
+		if f.BCD {
+			return fmt.Sprintf("strings.Repeat(%q, %d)", strconv.Itoa(i%10), f.Length*2), nil
+		}
+		n := f.Length
+		if n < 0 {
+			n = 3
+		}
+		return fmt.Sprintf("strings.Repeat(%q, %d)", string(rune('a'+(i-1)%26)), n), nil
+	}
+	return "", fmt.Errorf("unsupported field type %s", f.Type)
+}
+
+func snakeCase(s string) string {
+	var b strings.Builder
+	for i, r := range s {
+		if unicode.IsUpper(r) {
+			if i > 0 {
+				b.WriteByte('_')
+			}
+			r = unicode.ToLower(r)
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// 解析指令参数 key=value，以空格分隔
+func parseDirective(text string) (kind string, args map[string]string, err error) {
+	parts := strings.Fields(strings.TrimPrefix(text, directivePrefix))
+	if len(parts) == 0 {
+		return "", nil, fmt.Errorf("empty directive")
+	}
+	kind = parts[0]
+	args = map[string]string{}
+	for _, p := range parts[1:] {
+		kv := strings.SplitN(p, "=", 2)
+		if len(kv) != 2 || kv[1] == "" {
+			return "", nil, fmt.Errorf("invalid directive argument %q", p)
+		}
+		args[kv[0]] = kv[1]
+	}
+	return kind, args, nil
+}
+
+func parseField(fset *token.FileSet, f *ast.Field) ([]field, error) {
+	var typ string
+	switch t := f.Type.(type) {
+	case *ast.Ident:
+		typ = t.Name
+	case *ast.ArrayType:
+		if elt, ok := t.Elt.(*ast.Ident); ok && t.Len == nil && (elt.Name == "byte" || elt.Name == "uint8") {
+			typ = "[]byte"
+		}
+	}
+	switch typ {
+	case "byte", "uint8", "uint16", "uint32", "uint64", "[]byte", "string":
+	default:
+		return nil, fmt.Errorf("%s: unsupported field type", fset.Position(f.Pos()))
+	}
+	if len(f.Names) == 0 {
+		return nil, fmt.Errorf("%s: embedded field is not supported", fset.Position(f.Pos()))
+	}
+
+	fd := field{Type: typ, Length: -1}
+	if f.Tag != nil {
+		fd.Tag = f.Tag.Value
+		tag, err := strconv.Unquote(f.Tag.Value)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", fset.Position(f.Pos()), err)
+		}
+		for _, opt := range strings.Split(reflect.StructTag(tag).Get("bytecodec"), ";") {
+			kv := strings.SplitN(opt, ":", 2)
+			if len(kv) != 2 {
+				continue
+			}
+			switch kv[0] {
+			case "length":
+				fd.Length, err = strconv.Atoi(kv[1])
+			case "bcd8421":
+				fd.BCD = true
+				fd.Length, err = strconv.Atoi(strings.SplitN(kv[1], ",", 2)[0])
+			}
+			if err != nil {
+				return nil, fmt.Errorf("%s: invalid bytecodec tag %q", fset.Position(f.Pos()), tag)
+			}
+		}
+	}
+	if f.Comment != nil {
+		fd.Comment = strings.TrimSpace(f.Comment.Text())
+	}
+
+	var ret []field
+	for _, name := range f.Names {
+		fd.Name = name.Name
+		ret = append(ret, fd)
+	}
+	return ret, nil
+}
+
+func parseSchema(path string) ([]message, error) {
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, path, nil, parser.ParseComments)
+	if err != nil {
+		return nil, err
+	}
+
+	var msgs []message
+	for _, decl := range file.Decls {
+		gd, ok := decl.(*ast.GenDecl)
+		if !ok || gd.Tok != token.TYPE {
+			continue
+		}
+		for _, spec := range gd.Specs {
+			ts := spec.(*ast.TypeSpec)
+			st, ok := ts.Type.(*ast.StructType)
+			if !ok {
+				continue
+			}
+			doc := ts.Doc
+			if doc == nil {
+				doc = gd.Doc
+			}
+			m, ok, err := parseMessage(fset, ts.Name.Name, doc, st)
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				msgs = append(msgs, m)
+			}
+		}
+	}
+	return msgs, nil
+}
+
+func parseMessage(fset *token.FileSet, name string, doc *ast.CommentGroup, st *ast.StructType) (message, bool, error) {
+	m := message{Name: name}
+	if doc == nil {
+		return m, false, nil
+	}
+	found := false
+	for _, c := range doc.List {
+		if strings.HasPrefix(c.Text, directivePrefix) {
+			kind, args, err := parseDirective(c.Text)
+			if err != nil {
+				return m, false, fmt.Errorf("%s: %s", fset.Position(c.Pos()), err)
+			}
+			switch kind {
+			case "packet":
+			case "subpacket":
+				m.Sub = true
+			default:
+				return m, false, fmt.Errorf("%s: unknown directive %q", fset.Position(c.Pos()), kind)
+			}
+			m.Type, m.ID, m.Link, m.Dir, m.Main = args["type"], args["id"], args["link"], args["dir"], args["main"]
+			found = true
+			continue
+		}
+		line := strings.TrimSpace(strings.TrimPrefix(c.Text, "//"))
+		if line == "" {
+			continue
+		}
+		if m.Title == "" {
+			m.Title = line
+		} else {
+			m.Desc = append(m.Desc, line)
+		}
+	}
+	if !found {
+		return m, false, nil
+	}
+
+	pos := fset.Position(st.Pos())
+	switch {
+	case m.Type == "":
+		return m, false, fmt.Errorf("%s: %s missing type", pos, name)
+	case m.Title == "":
+		return m, false, fmt.Errorf("%s: %s missing title comment", pos, name)
+	case directions[m.Dir] == "":
+		return m, false, fmt.Errorf("%s: %s invalid dir %q", pos, name, m.Dir)
+	case !m.Sub && linkTypes[m.Link] == "":
+		return m, false, fmt.Errorf("%s: %s invalid link %q", pos, name, m.Link)
+	case m.Sub && m.Main == "":
+		return m, false, fmt.Errorf("%s: %s missing main", pos, name)
+	}
+	if m.ID != "" {
+		if _, err := strconv.ParseUint(m.ID, 0, 16); err != nil {
+			return m, false, fmt.Errorf("%s: %s invalid id %q", pos, name, m.ID)
+		}
+	}
+
+	for i, f := range st.Fields.List {
+		fields, err := parseField(fset, f)
+		if err != nil {
+			return m, false, err
+		}
+		// 没有长度的 slice 和 string 读取到数据结束，只能是最后一个字段
+		for _, fd := range fields {
+			if (fd.Type == "[]byte" || fd.Type == "string") && fd.Length < 0 && i != len(st.Fields.List)-1 {
+				return m, false, fmt.Errorf("%s: %s.%s without length must be the last field", pos, name, fd.Name)
+			}
+		}
+		m.Field = append(m.Field, fields...)
+	}
+	return m, true, nil
+}
+
+var packetTemplate = template.Must(template.New("packet").Parse(`// Code generated by genpacket from {{.Schema}}. DO NOT EDIT.
+
+package jt809
+
+import "fmt"
+{{with .Message}}{{if .ID}}
+const {{.Type}} uint16 = {{.ID}} // {{.Title}}{{if not .Sub}} {{.LinkName}}{{end}}
+{{end}}
+// {{.Title}}
+{{- if not .Sub}}
+// 链路类型：{{.LinkName}}。{{end}}
+// 消息方向：{{.DirName}}。
+{{- if .Sub}}
+// 子业务类型标识：{{.Type}}.{{else}}
+// 业务数据类型标识：{{.Type}}.{{end}}
+{{- range .Desc}}
+// {{.}}{{end}}
+{{- if not .Field}}
+// {{.Title}}，数据体为空。{{end}}
+type {{.Name}} struct {
+{{- if not .Sub}}
+	*headerSetter{{end}}
+{{- range .Field}}
+	{{.Name}} {{.Type}} {{.Tag}}{{if .Comment}} // {{.Comment}}{{end}}{{end}}
+}
+
+func New{{.Name}}() *{{.Name}} {
+{{- if .Sub}}
+	return &{{.Name}}{}{{else}}
+	p := &{{.Name}}{}
+	p.headerSetter = newHeaderSeter({{.Type}})
+	return p{{end}}
+}
+{{if .Sub}}
+func (p {{.Name}}) SubType() uint16 {
+	return {{.Type}}
+}
+{{else}}
+func (p {{.Name}}) LinkType() LinkType {
+	return {{.Link}}
+}
+{{end}}
+func (p {{.Name}}) String() string {
+	return fmt.Sprintf({{printf "%q" .StringFormat}}, {{.StringArgs}})
+}
+
+func init() {
+{{- if .Sub}}
+	if err := RegisterSubPacket({{.Main}}, {{.Type}}, func() SubPacket { return New{{.Name}}() }); err != nil {{"{"}}{{else}}
+	if err := RegisterPacket({{.Type}}, func() Packet { return New{{.Name}}() }); err != nil {{"{"}}{{end}}
+		panic(err)
+	}
+}
+{{end}}`))
+
+var testTemplate = template.Must(template.New("test").Parse(`// Code generated by genpacket from {{.Schema}}. DO NOT EDIT.
+
+package jt809
+
+import (
+{{- if .Bytes}}
+	"bytes"{{end}}
+{{- if .Strings}}
+	"strings"{{end}}
+	"testing"
+)
+{{range .Tests}}
+func TestGenerated{{.Name}}(t *testing.T) {
+	p := New{{.Name}}()
+{{- range .Values}}
+	p.{{.}}{{end}}
+{{- if .Sub}}
+	testSubRoundTrip(t, {{.Main}}, p){{else}}
+	testRoundTrip(t, p){{end}}
+}
+{{end}}`))
+
+type testCase struct {
+	message
+	Values []string
+}
+
+// 生成所有文件，返回文件名到内容
+func generate(schema string) (map[string][]byte, error) {
+	msgs, err := parseSchema(schema)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(msgs, func(i, j int) bool { return msgs[i].Name < msgs[j].Name })
+
+	files := map[string][]byte{}
+	base := filepath.Base(schema)
+	var (
+		tests       []testCase
+		usesBytes   bool
+		usesStrings bool
+		seenFile    = map[string]string{}
+	)
+	for _, m := range msgs {
+		if other, ok := seenFile[m.FileName()]; ok {
+			return nil, fmt.Errorf("%s and %s generate the same file %s", other, m.Name, m.FileName())
+		}
+		seenFile[m.FileName()] = m.Name
+
+		m.StringFormat, m.StringArgs = m.stringFormat()
+		buf := &bytes.Buffer{}
+		err := packetTemplate.Execute(buf, struct {
+			Schema  string
+			Message message
+		}{base, m})
+		if err != nil {
+			return nil, err
+		}
+		src, err := format.Source(buf.Bytes())
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s\n%s", m.Name, err, buf.Bytes())
+		}
+		files[m.FileName()] = src
+
+		tc := testCase{message: m}
+		for i, f := range m.Field {
+			v, err := f.TestValue(i + 1)
+			if err != nil {
+				return nil, fmt.Errorf("%s.%s: %s", m.Name, f.Name, err)
+			}
+			usesBytes = usesBytes || strings.HasPrefix(v, "bytes.")
+			usesStrings = usesStrings || strings.HasPrefix(v, "strings.")
+			tc.Values = append(tc.Values, f.Name+" = "+v)
+		}
+		tests = append(tests, tc)
+	}
+
+	buf := &bytes.Buffer{}
+	err = testTemplate.Execute(buf, struct {
+		Schema         string
+		Bytes, Strings bool
+		Tests          []testCase
+	}{base, usesBytes, usesStrings, tests})
+	if err != nil {
+		return nil, err
+	}
+	src, err := format.Source(buf.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("test: %s\n%s", err, buf.Bytes())
+	}
+	files["packets_gen_test.go"] = src
+	return files, nil
+}
+
+func main() {
+	schema := flag.String("schema", "packets_schema.go", "消息定义文件")
+	out := flag.String("out", ".", "生成文件的目录")
+	flag.Parse()
+
+	files, err := generate(*schema)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "genpacket:", err)
+		os.Exit(1)
+	}
+	for name, src := range files {
+		err := ioutil.WriteFile(filepath.Join(*out, name), src, 0644)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "genpacket:", err)
+			os.Exit(1)
+		}
+	}
+}
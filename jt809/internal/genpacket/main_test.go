@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// 生成的文件和消息定义保持一致，修改 packets_schema.go 后需要运行 go generate
+func TestGeneratedUpToDate(t *testing.T) {
+	files, err := generate("../../packets_schema.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, src := range files {
+		b, err := ioutil.ReadFile(filepath.Join("../..", name))
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if !bytes.Equal(b, src) {
+			t.Errorf("%s is out of date, run go generate in jt809", name)
+		}
+	}
+}
+
+func TestSchemaError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "genpacket")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, c := range []struct {
+		name, schema, err string
+	}{
+		{"missing title", "//jt809:packet type=A link=UpLink dir=up\ntype A struct{}", "missing title"},
+		{"invalid link", "// A\n//jt809:packet type=A link=Up dir=up\ntype A struct{}", "invalid link"},
+		{"invalid dir", "// A\n//jt809:packet type=A link=UpLink dir=left\ntype A struct{}", "invalid dir"},
+		{"missing main", "// A\n//jt809:subpacket type=A dir=up\ntype A struct{}", "missing main"},
+		{"invalid id", "// A\n//jt809:packet type=A id=0x10000 link=UpLink dir=up\ntype A struct{}", "invalid id"},
+		{"unknown directive", "// A\n//jt809:message type=A\ntype A struct{}", "unknown directive"},
+		{"unsupported type", "// A\n//jt809:packet type=A link=UpLink dir=up\ntype A struct{ F int }", "unsupported field type"},
+		{"unbounded field", "// A\n//jt809:packet type=A link=UpLink dir=up\ntype A struct{ F []byte; G byte }", "must be the last field"},
+	} {
+		path := filepath.Join(dir, "schema.go")
+		err := ioutil.WriteFile(path, []byte("package jt809\n\n"+c.schema+"\n"), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = generate(path)
+		if err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Errorf("%s: error %v, should contain %q", c.name, err, c.err)
+		}
+	}
+}
+
+func TestSnakeCase(t *testing.T) {
+	if s := snakeCase("DownTotalRecvBackMsg"); s != "down_total_recv_back_msg" {
+		t.Error("snakeCase error", s)
+	}
+}
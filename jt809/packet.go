@@ -1,6 +1,8 @@
 package jt809
 
 import (
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"sync"
 
@@ -32,8 +34,9 @@ const DOWN_TOTAL_RECV_BACK_MSG uint16 = 0x9101 // 接收定位信息数量通知
 
 //车辆动态信息交换类
 const (
-	UP_EXG_MSG               uint16 = 0x1200 // 主链路动态信息交换消息 主链路
-	UP_EXG_MSG_REAL_LOCATION uint16 = 0x1202 // 实时上传车辆定位信息 主链路
+	UP_EXG_MSG                  uint16 = 0x1200 // 主链路动态信息交换消息 主链路
+	UP_EXG_MSG_REAL_LOCATION    uint16 = 0x1202 // 实时上传车辆定位信息 主链路
+	UP_EXG_MSG_HISTORY_LOCATION uint16 = 0x1203 // 车辆定位信息自动补报请求消息 主链路
 )
 
 // 车牌颜色，按照 JT/T415-2006 中 5.4.12 的规定
@@ -45,25 +48,115 @@ const (
 	PlateColorOther  = 9 // 其他
 )
 
+// 协议版本，不同版本的数据头格式不同
+type Protocol byte
+
+const (
+	// JT/T 809-2011，默认
+	Protocol2011 Protocol = 0
+	// JT/T 809-2019，数据头最后增加 8 字节 UTC 时间
+	Protocol2019 Protocol = 1
+)
+
+func (p Protocol) String() string {
+	switch p {
+	case Protocol2011:
+		return "JT/T 809-2011"
+	case Protocol2019:
+		return "JT/T 809-2019"
+	}
+	return fmt.Sprintf("Protocol(%d)", byte(p))
+}
+
+// 数据头长度
+func (p Protocol) HeaderLength() int {
+	if p == Protocol2019 {
+		return HeaderLength2019
+	}
+	return HeaderLength
+}
+
+// 发送时默认使用的协议版本号
+func (p Protocol) Version() []byte {
+	if p == Protocol2019 {
+		return []byte{1, 2, 0}
+	}
+	return []byte{1, 0, 0}
+}
+
+type VersionMismatchErr struct {
+	Protocol Protocol
+	Version  []byte
+}
+
+func (e *VersionMismatchErr) Error() string {
+	return fmt.Sprintf("jt809 version %v mismatch %s", e.Version, e.Protocol)
+}
+
+// 检查协议版本号是否兼容，主版本号都是 1，2011 版本的次版本号小于 2，2019 版本的次版本号不小于 2
+func (p Protocol) ValidVersion(v []byte) error {
+	if len(v) != 3 || v[0] != 1 || (p == Protocol2019) != (v[1] >= 2) {
+		return &VersionMismatchErr{Protocol: p, Version: v}
+	}
+	return nil
+}
+
 // SerialNo 占用四个字节，为发送信息的序列号，用于接收方检测是否有信息的丢失。上级平台和下级平台按自己发送数据包的个数计数，互不影响。程序开始运行时等于零，发送第一帧数据时开始计数，到最大数后自动归零
 // Encrypt 用来区分报文是否进行加密，如果标识为1,则说明对后续相应业务的数据体采用 EncryptKey 对应的密钥进行加密处理。如果标识为0,则说明不进行加密处理
+// Time 只有 2019 版本的数据头中有，2011 版本编解码时忽略
 type Header struct {
 	Length       uint32 // 数据长度(包括头标识、数据头、数据体和尾标识)
 	SerialNo     uint32 // 报文序列号
 	Type         uint16 // 业务数据类型
 	GNSSCenterID uint32 // 下级平台接入码，上级平台给下级平台分配的唯一标识号
-	Version      []byte `bytecodec:"length:3"` // 协议版本号标识， 3 字节 上下级平台之间采用的标准协议版本编号；长度为三个字节来表示： 0x01 0x02 x0F 表示的版本号是V1.2.15,依此类推
+	Version      []byte // 协议版本号标识， 3 字节 上下级平台之间采用的标准协议版本编号；长度为三个字节来表示： 0x01 0x02 x0F 表示的版本号是V1.2.15,依此类推
 	Encrypt      byte   // 报文加密标识位：0表示报文不加密，1表示报文加密
 	EncryptKey   uint32 // 数据加密的密钥，长度为四个字节
+	Time         uint64 // 报文发送时的 UTC 时间，单位秒
 }
 
 func (h Header) String() string {
-	return fmt.Sprintf("Header{Length:%d SerialNo:%d, Type:%#04x, GNSSCenterID:%d, Version:%v, Encrypt:%d, EncryptKey:%d}", h.Length, h.SerialNo, h.Type, h.GNSSCenterID, h.Version, h.Encrypt, h.EncryptKey)
+	return fmt.Sprintf("Header{Length:%d SerialNo:%d, Type:%#04x, GNSSCenterID:%d, Version:%v, Encrypt:%d, EncryptKey:%d, Time:%d}", h.Length, h.SerialNo, h.Type, h.GNSSCenterID, h.Version, h.Encrypt, h.EncryptKey, h.Time)
+}
+
+// 把数据头写入 b，b 的长度至少是 p.HeaderLength()
+func (h *Header) put(b []byte, p Protocol) {
+	binary.BigEndian.PutUint32(b[0:], h.Length)
+	binary.BigEndian.PutUint32(b[4:], h.SerialNo)
+	binary.BigEndian.PutUint16(b[8:], h.Type)
+	binary.BigEndian.PutUint32(b[10:], h.GNSSCenterID)
+	copy(b[14:17], h.Version)
+	b[17] = h.Encrypt
+	binary.BigEndian.PutUint32(b[18:], h.EncryptKey)
+	if p == Protocol2019 {
+		binary.BigEndian.PutUint64(b[22:], h.Time)
+	}
 }
 
-// 数据头是定长的
+func (h *Header) unmarshal(b []byte, p Protocol) error {
+	if len(b) < p.HeaderLength() {
+		return fmt.Errorf("jt809 header length %d less than %d", len(b), p.HeaderLength())
+	}
+	h.Length = binary.BigEndian.Uint32(b[0:])
+	h.SerialNo = binary.BigEndian.Uint32(b[4:])
+	h.Type = binary.BigEndian.Uint16(b[8:])
+	h.GNSSCenterID = binary.BigEndian.Uint32(b[10:])
+	h.Version = append([]byte(nil), b[14:17]...)
+	h.Encrypt = b[17]
+	h.EncryptKey = binary.BigEndian.Uint32(b[18:])
+	h.Time = 0
+	if p == Protocol2019 {
+		h.Time = binary.BigEndian.Uint64(b[22:])
+	}
+	return nil
+}
+
+// 2011 版本的数据头是定长的
 const HeaderLength = 4 + 4 + 2 + 4 + 3 + 1 + 4 // 22
 
+// 2019 版本的数据头增加 8 字节时间
+const HeaderLength2019 = HeaderLength + 8 // 30
+
 type LinkType byte
 
 const (
@@ -131,20 +224,112 @@ func (seter *subPacketSetter) SetSubPacket(subpacket SubPacket) {
 	seter.subpacket = subpacket
 }
 
-var newPacketMap = map[uint16]func() Packet{
-	UP_CONNECT_REQ:    func() Packet { return NewUpConnectReq() },
-	UP_CONNECT_RSP:    func() Packet { return NewUpConnectRsp() },
-	UP_LINKTEST_REQ:   func() Packet { return NewUpLinkTestReq() },
-	UP_LINKTEST_RSP:   func() Packet { return NewUpLinkTestRsp() },
-	DOWN_CONNECT_REQ:  func() Packet { return NewDownConnectReq() },
-	DOWN_CONNECT_RSP:  func() Packet { return NewDownConnectRsp() },
-	DOWN_LINKTEST_REQ: func() Packet { return NewDownLinkTestReq() },
-	DOWN_LINKTEST_RSP: func() Packet { return NewDownLinkTestRsp() },
-	UP_EXG_MSG:        func() Packet { return NewUpExgMsg() },
+// packets_schema.go 中定义的消息由 genpacket 生成，在生成文件的 init 中注册
+//go:generate go run ./internal/genpacket -schema packets_schema.go
+
+var (
+	registryMtx sync.RWMutex
+
+	newPacketMap = map[uint16]func() Packet{
+		UP_CONNECT_REQ:    func() Packet { return NewUpConnectReq() },
+		UP_CONNECT_RSP:    func() Packet { return NewUpConnectRsp() },
+		UP_DISCONNECT_REQ: func() Packet { return NewUpDisconnectReq() },
+		UP_DISCONNECT_RSP: func() Packet { return NewUpDisconnectRsp() },
+		UP_LINKTEST_REQ:   func() Packet { return NewUpLinkTestReq() },
+		UP_LINKTEST_RSP:   func() Packet { return NewUpLinkTestRsp() },
+		DOWN_CONNECT_REQ:  func() Packet { return NewDownConnectReq() },
+		DOWN_CONNECT_RSP:  func() Packet { return NewDownConnectRsp() },
+		DOWN_LINKTEST_REQ: func() Packet { return NewDownLinkTestReq() },
+		DOWN_LINKTEST_RSP: func() Packet { return NewDownLinkTestRsp() },
+		UP_EXG_MSG:        func() Packet { return NewUpExgMsg() },
+	}
+
+	// 子业务类型只在所属的业务数据类型内唯一，按 主类型 -> 子类型 两级索引
+	newSubPacketMap = map[uint16]map[uint16]func() SubPacket{
+		UP_EXG_MSG: {
+			UP_EXG_MSG_REAL_LOCATION:    func() SubPacket { return NewUpExgMsgRealLocation() },
+			UP_EXG_MSG_HISTORY_LOCATION: func() SubPacket { return NewUpExgMsgHistoryLocation() },
+		},
+	}
+)
+
+type DuplicatePacketErr struct {
+	Type    uint16
+	SubType uint16
+	Sub     bool
+}
+
+func (e *DuplicatePacketErr) Error() string {
+	if e.Sub {
+		return fmt.Sprintf("jt809 duplicate subpacket %#04x of packet %#04x", e.SubType, e.Type)
+	}
+	return fmt.Sprintf("jt809 duplicate packet %#04x", e.Type)
+}
+
+// 注册的构造函数为 nil
+var ErrNilConstructor = errors.New("jt809 register nil constructor")
+
+// 注册业务数据类型 t 的构造函数，用于扩展标准中未实现的消息或者各省平台自定义的消息
+// 注册后 Decoder 可以自动解码该类型的数据包，t 已注册时返回 *DuplicatePacketErr，new 为 nil 时返回 ErrNilConstructor
+func RegisterPacket(t uint16, new func() Packet) error {
+	if new == nil {
+		return ErrNilConstructor
+	}
+	registryMtx.Lock()
+	defer registryMtx.Unlock()
+	if _, ok := newPacketMap[t]; ok {
+		return &DuplicatePacketErr{Type: t}
+	}
+	newPacketMap[t] = new
+	return nil
+}
+
+// 注册业务数据类型 mainType 下子业务类型 subType 的构造函数
+// mainType 的数据包需要实现 SubPacketSetter，subType 已注册时返回 *DuplicatePacketErr，new 为 nil 时返回 ErrNilConstructor
+func RegisterSubPacket(mainType, subType uint16, new func() SubPacket) error {
+	if new == nil {
+		return ErrNilConstructor
+	}
+	registryMtx.Lock()
+	defer registryMtx.Unlock()
+	subMap := newSubPacketMap[mainType]
+	if subMap == nil {
+		subMap = map[uint16]func() SubPacket{}
+		newSubPacketMap[mainType] = subMap
+	}
+	if _, ok := subMap[subType]; ok {
+		return &DuplicatePacketErr{Type: mainType, SubType: subType, Sub: true}
+	}
+	subMap[subType] = new
+	return nil
 }
 
-var newSubPacketMap = map[uint16]func() SubPacket{
-	UP_EXG_MSG_REAL_LOCATION: func() SubPacket { return NewUpExgMsgRealLocation() },
+func lookupPacket(t uint16) func() Packet {
+	registryMtx.RLock()
+	defer registryMtx.RUnlock()
+	return newPacketMap[t]
+}
+
+func lookupSubPacket(mainType, subType uint16) func() SubPacket {
+	registryMtx.RLock()
+	defer registryMtx.RUnlock()
+	return newSubPacketMap[mainType][subType]
+}
+
+// 删除注册的构造函数，测试中用于恢复全局的注册表
+func unregisterPacket(t uint16) {
+	registryMtx.Lock()
+	defer registryMtx.Unlock()
+	delete(newPacketMap, t)
+}
+
+func unregisterSubPacket(mainType, subType uint16) {
+	registryMtx.Lock()
+	defer registryMtx.Unlock()
+	delete(newSubPacketMap[mainType], subType)
+	if len(newSubPacketMap[mainType]) == 0 {
+		delete(newSubPacketMap, mainType)
+	}
 }
 
 func FixedLengthString(s string, length int, gbk bool) []byte {
@@ -1,6 +1,7 @@
 package jt809
 
 import (
+	"bytes"
 	"encoding/hex"
 	"fmt"
 	"reflect"
@@ -124,3 +125,287 @@ func TestUpExgMsgRealLocation(t *testing.T) {
 	}
 	testpacket(t, subtest)
 }
+
+const testCustomPacketType uint16 = 0x1f00
+
+type testCustomPacket struct {
+	*headerSetter
+	Value uint32
+}
+
+func (p testCustomPacket) LinkType() LinkType {
+	return UpLink
+}
+
+func (p testCustomPacket) String() string {
+	return fmt.Sprintf("testCustomPacket{Header:%s, Value:%d}", p.Header(), p.Value)
+}
+
+func TestRegisterPacket(t *testing.T) {
+	new := func() Packet { return &testCustomPacket{headerSetter: newHeaderSeter(testCustomPacketType)} }
+	err := RegisterPacket(testCustomPacketType, new)
+	if err != nil {
+		t.Fatal("RegisterPacket error", err)
+	}
+	t.Cleanup(func() { unregisterPacket(testCustomPacketType) })
+	err = RegisterPacket(testCustomPacketType, new)
+	if _, ok := err.(*DuplicatePacketErr); !ok {
+		t.Error("RegisterPacket duplicate should return DuplicatePacketErr", err)
+	}
+	err = RegisterPacket(UP_CONNECT_REQ, new)
+	if _, ok := err.(*DuplicatePacketErr); !ok {
+		t.Error("RegisterPacket builtin should return DuplicatePacketErr", err)
+	}
+	if err := RegisterPacket(testCustomPacketType+2, nil); err != ErrNilConstructor || lookupPacket(testCustomPacketType+2) != nil {
+		t.Error("RegisterPacket nil should return ErrNilConstructor", err)
+	}
+
+	p := new().(*testCustomPacket)
+	p.Value = 809
+	ret := mustUnmarshal(mustMarshal(p))
+	if !reflect.DeepEqual(ret, p) {
+		t.Error("custom packet roundtrip error", p, ret)
+	}
+}
+
+func TestRegisterSubPacket(t *testing.T) {
+	new := func() SubPacket { return NewUpExgMsgRealLocation() }
+	err := RegisterSubPacket(UP_EXG_MSG, UP_EXG_MSG_REAL_LOCATION, new)
+	if _, ok := err.(*DuplicatePacketErr); !ok {
+		t.Error("RegisterSubPacket builtin should return DuplicatePacketErr", err)
+	}
+	// 同一个子业务类型可以注册在不同的主业务类型下
+	err = RegisterSubPacket(testCustomPacketType+1, UP_EXG_MSG_REAL_LOCATION, new)
+	if err != nil {
+		t.Error("RegisterSubPacket error", err)
+	}
+	t.Cleanup(func() { unregisterSubPacket(testCustomPacketType+1, UP_EXG_MSG_REAL_LOCATION) })
+	if err := RegisterSubPacket(UP_EXG_MSG, 0x12ff, nil); err != ErrNilConstructor || lookupSubPacket(UP_EXG_MSG, 0x12ff) != nil {
+		t.Error("RegisterSubPacket nil should return ErrNilConstructor", err)
+	}
+}
+
+func TestUpExgMsgHistoryLocation(t *testing.T) {
+	gnsstime, _ := time.Parse("2006-01-02 15:04:05", "2021-12-20 12:49:09")
+	p := NewUpExgMsg()
+	p.VehicleNo = FixedLengthString("A12345", 21, true)
+	p.VehicleColor = PlateColorYellow
+
+	history := NewUpExgMsgHistoryLocation()
+	for i := 0; i < 3; i++ {
+		loc := NewUpExgMsgRealLocation()
+		loc.Date = GNSSDataDate(gnsstime)
+		loc.Time = GNSSDataTime(gnsstime.Add(time.Duration(i) * time.Second))
+		loc.Lon = 116397128
+		loc.Lat = 39916527
+		loc.State = &LocationStatus{ACC: true, Location: true}
+		history.Add(loc)
+	}
+	p.SetSubPacket(history)
+
+	ret := mustUnmarshal(mustMarshal(p)).(*UpExgMsg)
+	if ret.DataLength != 1+36*3 {
+		t.Error("UpExgMsgHistoryLocation DataLength error", ret.DataLength)
+	}
+	if !reflect.DeepEqual(ret, p) {
+		t.Error("UpExgMsgHistoryLocation roundtrip error", p, ret)
+	}
+}
+
+func TestRawPacket(t *testing.T) {
+	p := NewRawPacket(0x1f99, []byte{0x01, 0x5b, 0x02, 0x5d})
+	h := p.Header()
+	h.SerialNo = 7
+	h.GNSSCenterID = 20180920
+	h.Encrypt = 1
+	h.EncryptKey = 256178
+	frame := mustMarshal(p)
+
+	ret, err := Unmarshal(frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, ok := ret.(*RawPacket)
+	if !ok || raw.Header().Type != 0x1f99 || !bytes.Equal(raw.Body, p.Body) {
+		t.Fatal("unknown type should decode as RawPacket", ret)
+	}
+	if !bytes.Equal(mustMarshal(raw), frame) {
+		t.Error("RawPacket should re-encode byte-for-byte")
+	}
+	if raw.LinkType() != UpLink || NewRawPacket(0x9f99, nil).LinkType() != DownLink {
+		t.Error("RawPacket LinkType error")
+	}
+}
+
+func TestRawSubPacket(t *testing.T) {
+	p := NewUpExgMsg()
+	p.VehicleNo = FixedLengthString("A12345", 21, true)
+	p.VehicleColor = PlateColorYellow
+	p.SetSubPacket(NewRawSubPacket(0x12ff, []byte{0x01, 0x02, 0x03}))
+	frame := mustMarshal(p)
+
+	ret, err := Unmarshal(frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exgmsg, ok := ret.(*UpExgMsg)
+	if !ok {
+		t.Fatal("known type should decode as UpExgMsg", ret)
+	}
+	sub, ok := exgmsg.SubPacket().(*RawSubPacket)
+	if !ok || sub.SubType() != 0x12ff || !bytes.Equal(sub.Body, []byte{0x01, 0x02, 0x03}) {
+		t.Fatal("unknown sub type should decode as RawSubPacket", exgmsg.SubPacket())
+	}
+	if !bytes.Equal(mustMarshal(exgmsg), frame) {
+		t.Error("RawSubPacket should re-encode byte-for-byte")
+	}
+}
+
+// 和手写编解码字段相同、使用反射编解码的结构，用于对照测试和性能比较
+type reflectUpExgMsg struct {
+	VehicleNo    []byte `bytecodec:"length:21"`
+	VehicleColor byte
+	DataType     uint16
+	DataLength   uint32
+}
+
+type reflectRealLocation struct {
+	Encrypt   byte
+	Date      []byte `bytecodec:"length:4"`
+	Time      []byte `bytecodec:"length:3"`
+	Lon       uint32
+	Lat       uint32
+	Vec1      uint16
+	Vec2      uint16
+	Vec3      uint32
+	Direction uint16
+	Altitude  uint16
+	State     *LocationStatus
+	Alarm     *LocationAlarm
+}
+
+func testRealLocation() *UpExgMsgRealLocation {
+	gnsstime := time.Date(2021, 12, 20, 12, 49, 9, 0, time.UTC)
+	loc := NewUpExgMsgRealLocation()
+	loc.Date = GNSSDataDate(gnsstime)
+	loc.Time = GNSSDataTime(gnsstime)
+	loc.Lon = 116397128
+	loc.Lat = 39916527
+	loc.Vec1 = 60
+	loc.Vec2 = 58
+	loc.Vec3 = 123456
+	loc.Direction = 359
+	loc.Altitude = 44
+	loc.State = &LocationStatus{ACC: true, Location: true, DoorLocked: true}
+	loc.Alarm = &LocationAlarm{Speeding: true}
+	return loc
+}
+
+func TestUpExgMsgByteCoder(t *testing.T) {
+	loc := testRealLocation()
+	rloc := reflectRealLocation{loc.Encrypt, loc.Date, loc.Time, loc.Lon, loc.Lat, loc.Vec1, loc.Vec2, loc.Vec3, loc.Direction, loc.Altitude, loc.State, loc.Alarm}
+	msg := NewUpExgMsg()
+	msg.VehicleNo = FixedLengthString("A12345", 21, true)
+	msg.VehicleColor = PlateColorYellow
+	msg.DataType = UP_EXG_MSG_REAL_LOCATION
+	msg.DataLength = 36
+	rmsg := reflectUpExgMsg{msg.VehicleNo, msg.VehicleColor, msg.DataType, msg.DataLength}
+
+	for _, c := range []struct {
+		name            string
+		fast, reflected interface{}
+		newFast         func() interface{}
+		newReflected    func() interface{}
+	}{
+		{"UpExgMsg", msg, &rmsg, func() interface{} { return &UpExgMsg{} }, func() interface{} { return &reflectUpExgMsg{} }},
+		{"UpExgMsgRealLocation", loc, &rloc, func() interface{} { return &UpExgMsgRealLocation{} }, func() interface{} { return &reflectRealLocation{} }},
+	} {
+		want, err := bytecodec.Marshal(c.reflected)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := bytecodec.Marshal(c.fast)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("%s MarshalBytes %x, should be %x", c.name, got, want)
+		}
+
+		// 包括数据不足的情况，解码结果和错误都和反射编码一致
+		for n := 0; n <= len(want); n++ {
+			fast, reflected := c.newFast(), c.newReflected()
+			ferr := bytecodec.Unmarshal(want[:n], fast)
+			rerr := bytecodec.Unmarshal(want[:n], reflected)
+			if (ferr == nil) != (rerr == nil) {
+				t.Errorf("%s UnmarshalBytes %d bytes error %v, should be %v", c.name, n, ferr, rerr)
+				continue
+			}
+			if ferr != nil {
+				continue
+			}
+			fv, rv := reflect.ValueOf(fast).Elem(), reflect.ValueOf(reflected).Elem()
+			for i := 0; i < rv.NumField(); i++ {
+				name := rv.Type().Field(i).Name
+				if !reflect.DeepEqual(fv.FieldByName(name).Interface(), rv.Field(i).Interface()) {
+					t.Errorf("%s UnmarshalBytes %d bytes %s %v, should be %v", c.name, n, name, fv.FieldByName(name), rv.Field(i))
+				}
+			}
+		}
+	}
+
+	if _, err := bytecodec.Marshal(&UpExgMsgRealLocation{Date: []byte{1}, Time: []byte{1, 2, 3}}); err == nil {
+		t.Error("MarshalBytes should check Date length")
+	}
+}
+
+func BenchmarkUpExgMsgRealLocationMarshal(b *testing.B) {
+	loc := testRealLocation()
+	rloc := &reflectRealLocation{loc.Encrypt, loc.Date, loc.Time, loc.Lon, loc.Lat, loc.Vec1, loc.Vec2, loc.Vec3, loc.Direction, loc.Altitude, loc.State, loc.Alarm}
+	for _, c := range []struct {
+		name string
+		v    interface{}
+	}{{"ByteCoder", loc}, {"Reflect", rloc}} {
+		b.Run(c.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := bytecodec.Marshal(c.v); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkUpExgMsgRealLocationUnmarshal(b *testing.B) {
+	data, err := bytecodec.Marshal(testRealLocation())
+	if err != nil {
+		b.Fatal(err)
+	}
+	for _, c := range []struct {
+		name string
+		v    interface{}
+	}{{"ByteCoder", NewUpExgMsgRealLocation()}, {"Reflect", &reflectRealLocation{}}} {
+		b.Run(c.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if err := bytecodec.Unmarshal(data, c.v); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkUpExgMsgUnmarshal(b *testing.B) {
+	p := NewUpExgMsg()
+	p.VehicleNo = FixedLengthString("A12345", 21, true)
+	p.SetSubPacket(testRealLocation())
+	data := mustMarshal(p)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := Unmarshal(data); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+// Code generated by genpacket from packets_schema.go. DO NOT EDIT.
+
+package jt809
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestGeneratedDownCloseLinkInform(t *testing.T) {
+	p := NewDownCloseLinkInform()
+	p.ReasonCode = 1
+	testRoundTrip(t, p)
+}
+
+func TestGeneratedDownDisconnectInform(t *testing.T) {
+	p := NewDownDisconnectInform()
+	p.ErrorCode = 1
+	testRoundTrip(t, p)
+}
+
+func TestGeneratedDownDisconnectReq(t *testing.T) {
+	p := NewDownDisconnectReq()
+	p.VerifyCode = 0x01010101
+	testRoundTrip(t, p)
+}
+
+func TestGeneratedDownDisconnectRsp(t *testing.T) {
+	p := NewDownDisconnectRsp()
+	testRoundTrip(t, p)
+}
+
+func TestGeneratedDownTotalRecvBackMsg(t *testing.T) {
+	p := NewDownTotalRecvBackMsg()
+	p.DynamicInfoTotal = 0x01010101
+	p.StartTime = 0x0202020202020202
+	p.EndTime = 0x0303030303030303
+	testRoundTrip(t, p)
+}
+
+func TestGeneratedUpCloseLinkInform(t *testing.T) {
+	p := NewUpCloseLinkInform()
+	p.ReasonCode = 1
+	testRoundTrip(t, p)
+}
+
+func TestGeneratedUpDisconnectInform(t *testing.T) {
+	p := NewUpDisconnectInform()
+	p.ErrorCode = 1
+	testRoundTrip(t, p)
+}
+
+func TestGeneratedUpExgMsgRegister(t *testing.T) {
+	p := NewUpExgMsgRegister()
+	p.PlatformID = bytes.Repeat([]byte{1}, 11)
+	p.ProducerID = bytes.Repeat([]byte{2}, 11)
+	p.TerminalModelType = bytes.Repeat([]byte{3}, 8)
+	p.TerminalID = bytes.Repeat([]byte{4}, 7)
+	p.TerminalSimCode = bytes.Repeat([]byte{5}, 12)
+	testSubRoundTrip(t, UP_EXG_MSG, p)
+}
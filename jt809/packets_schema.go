@@ -0,0 +1,77 @@
+//go:build ignore
+// +build ignore
+
+// 消息定义，go generate 使用 internal/genpacket 根据这个文件生成 *_gen.go 和 packets_gen_test.go
+// 指令和字段的格式见 internal/genpacket，修改后重新运行 go generate，不要直接修改生成的文件
+
+package jt809
+
+// 主链路断开通知消息
+// 描述：当主链路中断后，下级平台可通过从链路向上级平台发送本消息通知上级平台主链路中断。
+//
+//jt809:packet type=UP_DISCONNECT_INFORM link=DownLinkOnly dir=up
+type UpDisconnectInform struct {
+	ErrorCode byte // 错误代码 0x00:主链路断开 0x01:其他原因
+}
+
+// 下级平台主动关闭链路通知消息
+// 描述：下级平台作为服务端，发现从链路出现异常时，下级平台通过从链路向上级平台发送本消息，通知上级平台下级平台即将关闭主从链路。
+//
+//jt809:packet type=UP_CLOSELINK_INFORM link=DownLinkOnly dir=up
+type UpCloseLinkInform struct {
+	ReasonCode byte // 链路关闭原因 0x00:网关重启 0x01:其他原因
+}
+
+// 从链路注销请求消息
+// 描述：从链路建立以后，上级平台在取消该链路时，应向下级平台发送从链路注销请求消息。
+//
+//jt809:packet type=DOWN_DISCONNECT_REQ link=DownLinkOnly dir=down
+type DownDisconnectReq struct {
+	VerifyCode uint32 // 主链路登录应答的校验码
+}
+
+// 从链路注销应答消息
+// 描述：下级平台在收到上级平台发送的从链路注销请求消息以后，返回从链路注销应答消息，记录相关日志，中断该从链路。
+//
+//jt809:packet type=DOWN_DISCONNECT_RSP link=DownLinkOnly dir=up
+type DownDisconnectRsp struct {
+}
+
+// 从链路断开通知消息
+// 描述：情景1：上级平台与下级平台的从链路中断后，重连三次仍未成功，上级平台通过主链路发送本消息给下级平台。
+// 情景2：上级平台作为客户端向下级平台登录时，根据之前收到的 IP 地址及端口无法连接到下级平台服务端时发送本消息通知下级平台。
+//
+//jt809:packet type=DOWN_DISCONNECT_INFORM link=UpLinkOnly dir=down
+type DownDisconnectInform struct {
+	ErrorCode byte // 错误代码 0x00:无法连接下级平台指定的服务 IP 与端口 0x01:上级平台客户端与下级平台服务端断开 0x02:其他原因
+}
+
+// 上级平台主动关闭链路通知消息
+// 描述：上级平台作为服务端，发现主链路出现异常时，上级平台通过主链路向下级平台发送本消息，通知下级平台上级平台即将关闭主从链路。
+//
+//jt809:packet type=DOWN_CLOSELINK_INFORM link=UpLinkOnly dir=down
+type DownCloseLinkInform struct {
+	ReasonCode byte // 链路关闭原因 0x00:网关重启 0x01:其他原因
+}
+
+// 接收定位信息数量通知消息
+// 描述：上级平台向下级平台定量通知已经收到下级平台上传的车辆定位信息数量（如：每收到 10000 条车辆定位信息通知一次）。
+//
+//jt809:packet type=DOWN_TOTAL_RECV_BACK_MSG link=DownLinkOnly dir=down
+type DownTotalRecvBackMsg struct {
+	DynamicInfoTotal uint32 // START_TIME~END_TIME 共收到的车辆定位信息数量
+	StartTime        uint64 // 开始时间，用 UTC 时间表示
+	EndTime          uint64 // 结束时间，用 UTC 时间表示
+}
+
+// 上传车辆注册信息消息
+// 描述：监控平台收到车载终端鉴权信息后，启动本命令向上级平台上传该车辆注册信息。
+//
+//jt809:subpacket type=UP_EXG_MSG_REGISTER id=0x1201 main=UP_EXG_MSG dir=up
+type UpExgMsgRegister struct {
+	PlatformID        []byte `bytecodec:"length:11"` // 平台唯一编码 11 字节
+	ProducerID        []byte `bytecodec:"length:11"` // 车载终端厂商唯一编码 11 字节
+	TerminalModelType []byte `bytecodec:"length:8"`  // 车载终端型号 8 字节，不足时以 0x00 补齐
+	TerminalID        []byte `bytecodec:"length:7"`  // 车载终端编号 7 字节，大写字母和数字组成
+	TerminalSimCode   []byte `bytecodec:"length:12"` // 车载终端 SIM 卡电话号码 12 字节，不足时前补 0
+}
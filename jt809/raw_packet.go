@@ -0,0 +1,46 @@
+package jt809
+
+import "fmt"
+
+// 没有注册的业务数据类型，保留数据头和解密之后的数据体
+// 可以记录、转发给其他平台，编码后和收到的报文一致
+type RawPacket struct {
+	*headerSetter
+	Body []byte
+}
+
+func NewRawPacket(t uint16, body []byte) *RawPacket {
+	p := &RawPacket{Body: body}
+	p.headerSetter = newHeaderSeter(t)
+	return p
+}
+
+// 按业务数据类型的最高位区分，0x9xxx 是上级平台发往下级平台的消息
+func (p RawPacket) LinkType() LinkType {
+	if p.Header().Type&0xf000 == 0x9000 {
+		return DownLink
+	}
+	return UpLink
+}
+
+func (p RawPacket) String() string {
+	return fmt.Sprintf("RawPacket{Header:%s, Body:%x}", p.Header(), p.Body)
+}
+
+// 没有注册的子业务类型，保留子业务数据体，外层的数据包正常解码
+type RawSubPacket struct {
+	Body    []byte
+	subType uint16
+}
+
+func NewRawSubPacket(subType uint16, body []byte) *RawSubPacket {
+	return &RawSubPacket{Body: body, subType: subType}
+}
+
+func (p RawSubPacket) SubType() uint16 {
+	return p.subType
+}
+
+func (p RawSubPacket) String() string {
+	return fmt.Sprintf("RawSubPacket{SubType:%#04x, Body:%x}", p.subType, p.Body)
+}
@@ -5,6 +5,8 @@ import (
 	"reflect"
 	"strings"
 	"testing"
+
+	"github.com/lai323/bytecodec"
 )
 
 func mustHexDecodeString(s string) []byte {
@@ -46,3 +48,34 @@ func testpacket(t *testing.T, subtest map[Packet][]byte) {
 		t.Log(strings.ToUpper(hex.EncodeToString(data)), packetRet)
 	}
 }
+
+// 编码后再解码，结果应该和原数据包一致
+func testRoundTrip(t *testing.T, p Packet) {
+	t.Helper()
+	data := mustMarshal(p)
+	packetRet := mustUnmarshal(data)
+	if !reflect.DeepEqual(packetRet, p) {
+		t.Error("Packet round trip error", p, strings.ToUpper(hex.EncodeToString(data)), packetRet)
+	}
+}
+
+// 子业务数据体编码后使用注册的构造函数解码，结果应该和原数据一致
+func testSubRoundTrip(t *testing.T, mainType uint16, p SubPacket) {
+	t.Helper()
+	new := lookupSubPacket(mainType, p.SubType())
+	if new == nil {
+		t.Fatalf("SubPacket %#04x of %#04x not registered", p.SubType(), mainType)
+	}
+	data, err := bytecodec.Marshal(p)
+	if err != nil {
+		t.Fatal("SubPacket Marshal error", p, err)
+	}
+	subpktRet := new()
+	err = bytecodec.Unmarshal(data, subpktRet)
+	if err != nil {
+		t.Fatal("SubPacket Unmarshal error", strings.ToUpper(hex.EncodeToString(data)), err)
+	}
+	if !reflect.DeepEqual(subpktRet, p) {
+		t.Error("SubPacket round trip error", p, strings.ToUpper(hex.EncodeToString(data)), subpktRet)
+	}
+}
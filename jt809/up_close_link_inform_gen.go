@@ -0,0 +1,35 @@
+// Code generated by genpacket from packets_schema.go. DO NOT EDIT.
+
+package jt809
+
+import "fmt"
+
+// 下级平台主动关闭链路通知消息
+// 链路类型：从链路。
+// 消息方向：下级平台往上级平台。
+// 业务数据类型标识：UP_CLOSELINK_INFORM.
+// 描述：下级平台作为服务端，发现从链路出现异常时，下级平台通过从链路向上级平台发送本消息，通知上级平台下级平台即将关闭主从链路。
+type UpCloseLinkInform struct {
+	*headerSetter
+	ReasonCode byte // 链路关闭原因 0x00:网关重启 0x01:其他原因
+}
+
+func NewUpCloseLinkInform() *UpCloseLinkInform {
+	p := &UpCloseLinkInform{}
+	p.headerSetter = newHeaderSeter(UP_CLOSELINK_INFORM)
+	return p
+}
+
+func (p UpCloseLinkInform) LinkType() LinkType {
+	return DownLinkOnly
+}
+
+func (p UpCloseLinkInform) String() string {
+	return fmt.Sprintf("UpCloseLinkInform{Header:%s, ReasonCode:%d}", p.Header(), p.ReasonCode)
+}
+
+func init() {
+	if err := RegisterPacket(UP_CLOSELINK_INFORM, func() Packet { return NewUpCloseLinkInform() }); err != nil {
+		panic(err)
+	}
+}
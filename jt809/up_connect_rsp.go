@@ -13,6 +13,17 @@ type UpConnectRsp struct {
 	VerifyCode uint32 // 校验码
 }
 
+// 主链路登录应答的验证结果
+const (
+	UpConnectSuccess           byte = 0x00 // 成功
+	UpConnectIPError           byte = 0x01 // IP地址不正确
+	UpConnectGNSSCenterIDError byte = 0x02 // 接入码不正确
+	UpConnectUnregistered      byte = 0x03 // 用户没有注册
+	UpConnectPasswordError     byte = 0x04 // 密码错误
+	UpConnectBusy              byte = 0x05 // 资源紧张，稍后再连接（已经占用）
+	UpConnectOther             byte = 0x06 // 其他
+)
+
 func NewUpConnectRsp() *UpConnectRsp {
 	p := &UpConnectRsp{}
 	p.headerSetter = newHeaderSeter(UP_CONNECT_RSP)
@@ -0,0 +1,35 @@
+// Code generated by genpacket from packets_schema.go. DO NOT EDIT.
+
+package jt809
+
+import "fmt"
+
+// 主链路断开通知消息
+// 链路类型：从链路。
+// 消息方向：下级平台往上级平台。
+// 业务数据类型标识：UP_DISCONNECT_INFORM.
+// 描述：当主链路中断后，下级平台可通过从链路向上级平台发送本消息通知上级平台主链路中断。
+type UpDisconnectInform struct {
+	*headerSetter
+	ErrorCode byte // 错误代码 0x00:主链路断开 0x01:其他原因
+}
+
+func NewUpDisconnectInform() *UpDisconnectInform {
+	p := &UpDisconnectInform{}
+	p.headerSetter = newHeaderSeter(UP_DISCONNECT_INFORM)
+	return p
+}
+
+func (p UpDisconnectInform) LinkType() LinkType {
+	return DownLinkOnly
+}
+
+func (p UpDisconnectInform) String() string {
+	return fmt.Sprintf("UpDisconnectInform{Header:%s, ErrorCode:%d}", p.Header(), p.ErrorCode)
+}
+
+func init() {
+	if err := RegisterPacket(UP_DISCONNECT_INFORM, func() Packet { return NewUpDisconnectInform() }); err != nil {
+		panic(err)
+	}
+}
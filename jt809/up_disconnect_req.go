@@ -0,0 +1,28 @@
+package jt809
+
+import "fmt"
+
+// 主链路注销请求消息
+// 链路类型：主链路。
+// 消息方向：下级平台往上级平台。
+// 业务数据类型标识： UP_DISCONNECT_REQ.
+// 描述：下级平台在中断与上级平台的主链路连接时，应向上级平台发送主链路注销请求消息。
+type UpDisconnectReq struct {
+	*headerSetter
+	UserID   uint32 // 用户名
+	Password []byte `bytecodec:"length:8"` // 密码 8 字节
+}
+
+func NewUpDisconnectReq() *UpDisconnectReq {
+	p := &UpDisconnectReq{}
+	p.headerSetter = newHeaderSeter(UP_DISCONNECT_REQ)
+	return p
+}
+
+func (p UpDisconnectReq) LinkType() LinkType {
+	return UpLinkOnly
+}
+
+func (p UpDisconnectReq) String() string {
+	return fmt.Sprintf("UpDisconnectReq{Header:%s UserID:%d, Password:%s}", p.Header(), p.UserID, p.Password)
+}
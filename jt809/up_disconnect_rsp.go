@@ -0,0 +1,27 @@
+package jt809
+
+import "fmt"
+
+// 主链路注销应答消息
+// 链路类型：主链路。
+// 消息方向：上级平台往下级平台。
+// 业务数据类型标识： UP_DISCONNECT_RSP.
+// 描述：上级平台收到下级平台发送的主链路注销请求消息后，向下级平台返回主链路注销应答消息，并记录链路注销日志，下级平台接收到应答消息后，可中断主从链路联接。
+// 主链路注销应答消息，数据体为空。
+type UpDisconnectRsp struct {
+	*headerSetter
+}
+
+func NewUpDisconnectRsp() *UpDisconnectRsp {
+	p := &UpDisconnectRsp{}
+	p.headerSetter = newHeaderSeter(UP_DISCONNECT_RSP)
+	return p
+}
+
+func (p UpDisconnectRsp) LinkType() LinkType {
+	return UpLinkOnly
+}
+
+func (p UpDisconnectRsp) String() string {
+	return fmt.Sprintf("UpDisconnectRsp{Header:%s}", p.Header())
+}
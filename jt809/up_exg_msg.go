@@ -1,8 +1,10 @@
 package jt809
 
 import (
+	"bytes"
 	"encoding/binary"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/lai323/bytecodec"
@@ -50,10 +52,37 @@ func (p UpExgMsg) LinkType() LinkType {
 	return UpLink
 }
 
+// 车牌号和车牌颜色唯一确定一辆车
+func (p UpExgMsg) VehicleKey() string {
+	return fmt.Sprintf("%s/%d", bytes.TrimRight(p.VehicleNo, "\x00"), p.VehicleColor)
+}
+
 func (p UpExgMsg) String() string {
 	return fmt.Sprintf("UpExgMsg{Header:%s, VehicleNo:%s, VehicleColor:%d, DataType:%#04x, DataLength:%d, SubPacket:%s}", p.Header(), p.VehicleNo, p.VehicleColor, p.DataType, p.DataLength, p.SubPacket())
 }
 
+// 车辆动态信息交换的数据量最大，手写编解码避免反射，格式和 bytecodec 按字段编码的结果一致
+func (p *UpExgMsg) MarshalBytes(cs *bytecodec.CodecState) error {
+	if len(p.VehicleNo) != 21 {
+		return fmt.Errorf("jt809 UpExgMsg VehicleNo length %d, should be 21", len(p.VehicleNo))
+	}
+	cs.Write(p.VehicleNo)
+	cs.WriteByte(p.VehicleColor)
+	writeUint16(cs, p.DataType)
+	writeUint32(cs, p.DataLength)
+	return nil
+}
+
+func (p *UpExgMsg) UnmarshalBytes(cs *bytecodec.CodecState) error {
+	p.VehicleNo = readBytes(cs, 21)
+	p.VehicleColor = cs.ReadByte()
+	p.DataType = readUint16(cs)
+	p.DataLength = readUint32(cs)
+	return nil
+}
+
+// 编码定位数据的日期，使用 t 的时区，标准规定使用北京时间，GNSSData 会自动转换
+// ParseGNSSDataTime 解析 GNSSDataDate 和 GNSSDataTime 的结果
 func GNSSDataDate(t time.Time) []byte {
 	d := byte(t.Day())
 	m := byte(t.Month())
@@ -70,7 +99,7 @@ func GNSSDataTime(t time.Time) []byte {
 	return []byte{h, m, s}
 }
 
-// 上传车辆注册信息消息
+// 实时上传车辆定位信息消息
 // 子业务类型标识： UP_EXG_MSG_REAL_LOCATION
 // 描述：主要描述车辆的实时定位信息，本条消息服务端无需应答。
 type UpExgMsgRealLocation struct {
@@ -103,6 +132,100 @@ func (p UpExgMsgRealLocation) String() string {
 	return fmt.Sprintf("UpExgMsgRealLocation{Encrypt:%d, Date:%#x, Time:%#x, Lon:%d, Lat:%d, Vec1:%d, Vec2:%d, Vec3:%d, Direction:%d, Altitude:%d, State:%s, Alarm:%s}", p.Encrypt, p.Date, p.Time, p.Lon, p.Lat, p.Vec1, p.Vec2, p.Vec3, p.Direction, p.Altitude, p.State, p.Alarm)
 }
 
+func (p *UpExgMsgRealLocation) MarshalBytes(cs *bytecodec.CodecState) error {
+	if len(p.Date) != 4 {
+		return fmt.Errorf("jt809 UpExgMsgRealLocation Date length %d, should be 4", len(p.Date))
+	}
+	if len(p.Time) != 3 {
+		return fmt.Errorf("jt809 UpExgMsgRealLocation Time length %d, should be 3", len(p.Time))
+	}
+	cs.WriteByte(p.Encrypt)
+	cs.Write(p.Date)
+	cs.Write(p.Time)
+	writeUint32(cs, p.Lon)
+	writeUint32(cs, p.Lat)
+	writeUint16(cs, p.Vec1)
+	writeUint16(cs, p.Vec2)
+	writeUint32(cs, p.Vec3)
+	writeUint16(cs, p.Direction)
+	writeUint16(cs, p.Altitude)
+	var state uint32
+	if p.State != nil {
+		state = p.State.Uint32()
+	}
+	writeUint32(cs, state)
+	var alarm uint32
+	if p.Alarm != nil {
+		alarm = p.Alarm.Uint32()
+	}
+	writeUint32(cs, alarm)
+	return nil
+}
+
+func (p *UpExgMsgRealLocation) UnmarshalBytes(cs *bytecodec.CodecState) error {
+	p.Encrypt = cs.ReadByte()
+	p.Date = readBytes(cs, 4)
+	p.Time = readBytes(cs, 3)
+	p.Lon = readUint32(cs)
+	p.Lat = readUint32(cs)
+	p.Vec1 = readUint16(cs)
+	p.Vec2 = readUint16(cs)
+	p.Vec3 = readUint32(cs)
+	p.Direction = readUint16(cs)
+	p.Altitude = readUint16(cs)
+	// 和反射编码一致，数据结束时保留原来的状态
+	if cs.Len() == 0 {
+		return nil
+	}
+	if p.State == nil {
+		p.State = &LocationStatus{}
+	}
+	if err := p.State.UnmarshalBytes(cs); err != nil {
+		return err
+	}
+	if cs.Len() == 0 {
+		return nil
+	}
+	if p.Alarm == nil {
+		p.Alarm = &LocationAlarm{}
+	}
+	return p.Alarm.UnmarshalBytes(cs)
+}
+
+// 车辆定位信息自动补报请求消息
+// 子业务类型标识： UP_EXG_MSG_HISTORY_LOCATION
+// 描述：如果在主从链路都断开后，下级平台重新登录成功，下级平台应将中断期间内的车辆定位信息自动补报到上级平台。
+// 本条消息服务端无需应答。
+type UpExgMsgHistoryLocation struct {
+	GNSSCount byte                   // 卫星定位数据个数 1 <= GNSSCount <= 5
+	GNSSData  []UpExgMsgRealLocation // 卫星定位数据，格式与实时上传车辆定位信息相同
+}
+
+// 一条补报消息最多包含的定位数据个数
+const MaxHistoryLocationCount = 5
+
+func NewUpExgMsgHistoryLocation() *UpExgMsgHistoryLocation {
+	return &UpExgMsgHistoryLocation{}
+}
+
+// 添加定位数据，同时更新 GNSSCount
+func (p *UpExgMsgHistoryLocation) Add(loc *UpExgMsgRealLocation) {
+	p.GNSSData = append(p.GNSSData, *loc)
+	p.GNSSCount = byte(len(p.GNSSData))
+}
+
+func (p UpExgMsgHistoryLocation) SubType() uint16 {
+	return UP_EXG_MSG_HISTORY_LOCATION
+}
+
+func (p UpExgMsgHistoryLocation) String() string {
+	locs := make([]string, len(p.GNSSData))
+	for i, loc := range p.GNSSData {
+		locs[i] = loc.String()
+	}
+	return fmt.Sprintf("UpExgMsgHistoryLocation{GNSSCount:%d, GNSSData:[%s]}", p.GNSSCount, strings.Join(locs, ", "))
+}
+
 type LocationStatus struct {
 	ACC           bool // 0    0:ACC关；1:ACC开
 	Location      bool // 1    0:未定位；1:定位
@@ -140,17 +263,12 @@ func (s LocationStatus) Uint32() uint32 {
 }
 
 func (s *LocationStatus) MarshalBytes(cs *bytecodec.CodecState) error {
-	v := s.Uint32()
-	b := make([]byte, 4)
-	binary.BigEndian.PutUint32(b, v)
-	cs.Write(b)
+	writeUint32(cs, s.Uint32())
 	return nil
 }
 
 func (s *LocationStatus) UnmarshalBytes(cs *bytecodec.CodecState) error {
-	b := make([]byte, 4)
-	cs.ReadFull(b)
-	v := binary.BigEndian.Uint32(b)
+	v := readUint32(cs)
 	bools := BinToBoolSlice(uint64(v))
 	s.ACC = bools[0]
 	s.Location = bools[1]
@@ -233,17 +351,12 @@ func (s LocationAlarm) Uint32() uint32 {
 }
 
 func (s *LocationAlarm) MarshalBytes(cs *bytecodec.CodecState) error {
-	v := s.Uint32()
-	b := make([]byte, 4)
-	binary.BigEndian.PutUint32(b, v)
-	cs.Write(b)
+	writeUint32(cs, s.Uint32())
 	return nil
 }
 
 func (s *LocationAlarm) UnmarshalBytes(cs *bytecodec.CodecState) error {
-	b := make([]byte, 4)
-	cs.ReadFull(b)
-	v := binary.BigEndian.Uint32(b)
+	v := readUint32(cs)
 	bools := BinToBoolSlice(uint64(v))
 	s.Emergency = bools[0]
 	s.Speeding = bools[1]
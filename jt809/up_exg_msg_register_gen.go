@@ -0,0 +1,37 @@
+// Code generated by genpacket from packets_schema.go. DO NOT EDIT.
+
+package jt809
+
+import "fmt"
+
+const UP_EXG_MSG_REGISTER uint16 = 0x1201 // 上传车辆注册信息消息
+
+// 上传车辆注册信息消息
+// 消息方向：下级平台往上级平台。
+// 子业务类型标识：UP_EXG_MSG_REGISTER.
+// 描述：监控平台收到车载终端鉴权信息后，启动本命令向上级平台上传该车辆注册信息。
+type UpExgMsgRegister struct {
+	PlatformID        []byte `bytecodec:"length:11"` // 平台唯一编码 11 字节
+	ProducerID        []byte `bytecodec:"length:11"` // 车载终端厂商唯一编码 11 字节
+	TerminalModelType []byte `bytecodec:"length:8"`  // 车载终端型号 8 字节，不足时以 0x00 补齐
+	TerminalID        []byte `bytecodec:"length:7"`  // 车载终端编号 7 字节，大写字母和数字组成
+	TerminalSimCode   []byte `bytecodec:"length:12"` // 车载终端 SIM 卡电话号码 12 字节，不足时前补 0
+}
+
+func NewUpExgMsgRegister() *UpExgMsgRegister {
+	return &UpExgMsgRegister{}
+}
+
+func (p UpExgMsgRegister) SubType() uint16 {
+	return UP_EXG_MSG_REGISTER
+}
+
+func (p UpExgMsgRegister) String() string {
+	return fmt.Sprintf("UpExgMsgRegister{PlatformID:%x, ProducerID:%x, TerminalModelType:%x, TerminalID:%x, TerminalSimCode:%x}", p.PlatformID, p.ProducerID, p.TerminalModelType, p.TerminalID, p.TerminalSimCode)
+}
+
+func init() {
+	if err := RegisterSubPacket(UP_EXG_MSG, UP_EXG_MSG_REGISTER, func() SubPacket { return NewUpExgMsgRegister() }); err != nil {
+		panic(err)
+	}
+}
@@ -0,0 +1,184 @@
+package jt809server
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/lai323/jt809server/jt809"
+)
+
+// 返回 true 时车辆动态信息上传到这个上级平台，可以按车辆、区域等条件选择上级平台
+type RouteFunc func(p *jt809.UpExgMsg) bool
+
+type upstream struct {
+	name  string
+	srv   *Server
+	route RouteFunc
+
+	serving bool
+	err     error
+}
+
+// 同时连接多个上级平台，例如省平台、全国平台和市级平台，每个上级平台使用单独的 Server
+type Manager struct {
+	logger    log.Logger
+	mtx       sync.Mutex
+	upstreams []*upstream
+	wg        sync.WaitGroup
+}
+
+func NewManager(logger log.Logger) *Manager {
+	return &Manager{logger: logger}
+}
+
+// 添加上级平台，route 为 nil 时上传所有车辆的数据，需要在 Serve 之前调用
+func (m *Manager) Add(name string, srv *Server, route RouteFunc) error {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	for _, u := range m.upstreams {
+		if u.name == name {
+			return fmt.Errorf("jt809server duplicate upstream %s", name)
+		}
+	}
+	m.upstreams = append(m.upstreams, &upstream{name: name, srv: srv, route: route})
+	return nil
+}
+
+func (m *Manager) Server(name string) *Server {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	for _, u := range m.upstreams {
+		if u.name == name {
+			return u.srv
+		}
+	}
+	return nil
+}
+
+// 启动所有上级平台的连接，所有 Server 退出后返回
+func (m *Manager) Serve(ctx context.Context) error {
+	m.mtx.Lock()
+	for _, u := range m.upstreams {
+		u := u
+		u.serving = true
+		m.wg.Add(1)
+		safego(func() {
+			defer m.wg.Done()
+			err := u.srv.Serve(ctx)
+			if err != nil {
+				level.Error(m.logger).Log("msg", "Manager upstream Serve", "upstream", u.name, "error", err)
+			}
+			m.mtx.Lock()
+			u.serving = false
+			u.err = err
+			m.mtx.Unlock()
+		}, m.logger, "manager upstream serve panic")
+	}
+	m.mtx.Unlock()
+
+	m.wg.Wait()
+	return nil
+}
+
+// 并发关闭所有上级平台的连接
+func (m *Manager) Shutdown(ctx context.Context) error {
+	m.mtx.Lock()
+	upstreams := append([]*upstream(nil), m.upstreams...)
+	m.mtx.Unlock()
+
+	var (
+		wg   sync.WaitGroup
+		emtx sync.Mutex
+		errs = map[string]error{}
+	)
+	for _, u := range upstreams {
+		u := u
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := u.srv.Shutdown(ctx)
+			if err != nil {
+				emtx.Lock()
+				errs[u.name] = err
+				emtx.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if len(errs) > 0 {
+		return &UpstreamErrors{Errors: errs}
+	}
+	return nil
+}
+
+// 上传到多个上级平台时，每个上级平台的发送错误
+type UpstreamErrors struct {
+	Errors map[string]error
+}
+
+func (e *UpstreamErrors) Error() string {
+	var names []string
+	for name := range e.Errors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	msgs := make([]string, len(names))
+	for i, name := range names {
+		msgs[i] = fmt.Sprintf("%s: %s", name, e.Errors[name])
+	}
+	return "jt809server upstream errors: " + strings.Join(msgs, "; ")
+}
+
+// 上传车辆动态信息到所有匹配的上级平台，部分上级平台发送失败时返回 *UpstreamErrors
+// 各个 Server 依次编码同一个数据包，调用方不要在返回前修改 p
+func (m *Manager) UpExgMsg(p *jt809.UpExgMsg) error {
+	m.mtx.Lock()
+	upstreams := append([]*upstream(nil), m.upstreams...)
+	m.mtx.Unlock()
+
+	errs := map[string]error{}
+	for _, u := range upstreams {
+		if u.route != nil && !u.route(p) {
+			continue
+		}
+		err := u.srv.Send(p)
+		if err != nil {
+			errs[u.name] = err
+		}
+	}
+	if len(errs) > 0 {
+		return &UpstreamErrors{Errors: errs}
+	}
+	return nil
+}
+
+func (m *Manager) UpRealLocation(loc *jt809.UpExgMsg) error {
+	return m.UpExgMsg(loc)
+}
+
+type UpstreamStatus struct {
+	Name    string
+	Serving bool
+	Status
+	Err error // Serve 返回的错误
+}
+
+func (m *Manager) Status() []UpstreamStatus {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	ret := make([]UpstreamStatus, len(m.upstreams))
+	for i, u := range m.upstreams {
+		ret[i] = UpstreamStatus{
+			Name:    u.name,
+			Serving: u.serving,
+			Status:  u.srv.Status(),
+			Err:     u.err,
+		}
+	}
+	return ret
+}
@@ -0,0 +1,39 @@
+package jt809server
+
+import (
+	"testing"
+
+	"github.com/go-kit/log"
+	"github.com/lai323/jt809server/jt809"
+)
+
+func TestManagerRoute(t *testing.T) {
+	m := NewManager(log.NewNopLogger())
+	m.Add("province", NewServer(log.NewNopLogger()), nil)
+	m.Add("city", NewServer(log.NewNopLogger()), func(p *jt809.UpExgMsg) bool {
+		return p.VehicleColor == jt809.PlateColorBlue
+	})
+	if err := m.Add("city", NewServer(log.NewNopLogger()), nil); err == nil {
+		t.Error("Manager Add duplicate upstream should return error")
+	}
+
+	p := jt809.NewUpExgMsg()
+	p.VehicleColor = jt809.PlateColorYellow
+	err := m.UpExgMsg(p)
+	errs, ok := err.(*UpstreamErrors)
+	if !ok || len(errs.Errors) != 1 || errs.Errors["province"] != ErrNotLoggedIn {
+		t.Error("Manager UpExgMsg route error", err)
+	}
+
+	p.VehicleColor = jt809.PlateColorBlue
+	err = m.UpExgMsg(p)
+	errs, ok = err.(*UpstreamErrors)
+	if !ok || len(errs.Errors) != 2 {
+		t.Error("Manager UpExgMsg route error", err)
+	}
+
+	status := m.Status()
+	if len(status) != 2 || status[0].Name != "province" || status[0].LoggedIn {
+		t.Error("Manager Status error", status)
+	}
+}
@@ -0,0 +1,279 @@
+package jt809server
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/lai323/jt809server/jt809"
+)
+
+// 发送队列满时的处理方式
+type QueuePolicy byte
+
+const (
+	// 阻塞等待队列有空位
+	QueueBlock QueuePolicy = 0
+	// 丢弃队列中最早的数据包
+	QueueDropOldest QueuePolicy = 1
+	// 直接返回 ErrQueueFull
+	QueueError QueuePolicy = 2
+)
+
+const defaultSendQueueSize = 1024
+
+var (
+	ErrQueueFull   = errors.New("jt809server send queue full")
+	ErrQueueClosed = errors.New("jt809server send queue closed")
+)
+
+// flushed 不为空时是 drain 添加的标记，写入 goroutine 处理到这里时 Flush 并关闭 flushed
+// written 不为空时在帧写入连接后调用，参数为 nil；写入失败、被丢弃或者队列关闭时参数为对应的错误
+type queueItem struct {
+	frame   *[]byte
+	flushed chan struct{}
+	written func(error)
+}
+
+// 每条链路一个发送队列，由单独的 goroutine 写入连接，调用方不会被慢速链路阻塞
+type sendQueue struct {
+	name   string
+	conn   net.Conn
+	enc    *jt809.Encoder
+	policy QueuePolicy
+	logger log.Logger
+	// 返回过 ErrQueueFull 之后队列清空时调用
+	onRoom func()
+	full   int32
+
+	// 保证数据包的编码顺序和入队顺序一致
+	mtx       sync.Mutex
+	ch        chan queueItem
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// opts 是这条连接的编码选项，队列在连接的整个生命周期内复用同一个 Encoder
+// onRoom 可以为空，在写入 goroutine 中调用，不能阻塞
+func newSendQueue(name string, conn net.Conn, size int, policy QueuePolicy, logger log.Logger, onRoom func(), opts ...jt809.Option) *sendQueue {
+	if size <= 0 {
+		size = defaultSendQueueSize
+	}
+	q := &sendQueue{
+		name:   name,
+		conn:   conn,
+		enc:    jt809.NewEncoder(conn, opts...),
+		policy: policy,
+		logger: logger,
+		onRoom: onRoom,
+		ch:     make(chan queueItem, size),
+		done:   make(chan struct{}),
+	}
+	safego(q.run, logger, "send queue panic")
+	return q
+}
+
+// 写入连接后放回的帧缓冲区
+const maxPooledFrameSize = 64 << 10
+
+var framePool = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, 0, 256)
+		return &b
+	},
+}
+
+func putFrame(frame *[]byte) {
+	if frame != nil && cap(*frame) <= maxPooledFrameSize {
+		framePool.Put(frame)
+	}
+}
+
+// 编码并入队，encode 在队列的锁内调用，把帧追加到 dst 后返回
+func (q *sendQueue) push(encode func(enc *jt809.Encoder, dst []byte) ([]byte, error)) error {
+	return q.pushNotify(encode, nil)
+}
+
+// 和 push 相同，入队成功时 written 一定会被调用一次，返回错误时不会调用
+func (q *sendQueue) pushNotify(encode func(enc *jt809.Encoder, dst []byte) ([]byte, error), written func(error)) error {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+
+	select {
+	case <-q.done:
+		return ErrQueueClosed
+	default:
+	}
+
+	frame := framePool.Get().(*[]byte)
+	b, err := encode(q.enc, (*frame)[:0])
+	*frame = b
+	if err != nil {
+		putFrame(frame)
+		return err
+	}
+	item := queueItem{frame: frame, written: written}
+
+	switch q.policy {
+	case QueueError:
+		select {
+		case q.ch <- item:
+			return nil
+		default:
+			putFrame(frame)
+			atomic.StoreInt32(&q.full, 1)
+			return ErrQueueFull
+		}
+	case QueueDropOldest:
+		for {
+			select {
+			case q.ch <- item:
+				return nil
+			default:
+			}
+			select {
+			case dropped := <-q.ch:
+				if dropped.flushed != nil {
+					close(dropped.flushed)
+					continue
+				}
+				putFrame(dropped.frame)
+				if dropped.written != nil {
+					dropped.written(ErrQueueFull)
+				}
+				level.Warn(q.logger).Log("msg", "send queue full, drop oldest", "conn", q.name)
+			default:
+			}
+		}
+	default:
+		select {
+		case q.ch <- item:
+			return nil
+		case <-q.done:
+			return ErrQueueClosed
+		}
+	}
+}
+
+// 等待队列中已有的数据包写入连接
+func (q *sendQueue) drain(ctx context.Context) error {
+	flushed := make(chan struct{})
+	q.mtx.Lock()
+	select {
+	case q.ch <- queueItem{flushed: flushed}:
+	case <-q.done:
+		q.mtx.Unlock()
+		return ErrQueueClosed
+	case <-ctx.Done():
+		q.mtx.Unlock()
+		return ctx.Err()
+	}
+	q.mtx.Unlock()
+
+	select {
+	case <-flushed:
+		return nil
+	case <-q.done:
+		return ErrQueueClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (q *sendQueue) run() {
+	w := bufio.NewWriter(q.conn)
+	// 已经写入 bufio.Writer，等待 Flush 之后才能确认的回调
+	var pending []func(error)
+	for {
+		select {
+		case item := <-q.ch:
+			var err error
+			if item.frame != nil {
+				_, err = w.Write(*item.frame)
+				// bufio.Writer 已经复制或者写出了数据，帧缓冲区可以复用
+				putFrame(item.frame)
+				if item.written != nil {
+					pending = append(pending, item.written)
+				}
+			}
+			// 队列中没有待发送的数据包时才 Flush，减少系统调用
+			if err == nil && (len(q.ch) == 0 || item.flushed != nil) {
+				err = w.Flush()
+				if err == nil {
+					for _, written := range pending {
+						written(nil)
+					}
+					pending = pending[:0]
+					if len(q.ch) == 0 && atomic.CompareAndSwapInt32(&q.full, 1, 0) && q.onRoom != nil {
+						q.onRoom()
+					}
+				}
+			}
+			if err == nil && item.flushed != nil {
+				close(item.flushed)
+			}
+			if err != nil {
+				level.Error(q.logger).Log("msg", "send queue write error", "conn", q.name, "error", err)
+				q.close()
+				q.conn.Close()
+				q.abort(pending, err)
+				return
+			}
+		case <-q.done:
+			q.abort(pending, ErrQueueClosed)
+			return
+		}
+	}
+}
+
+// 写入 goroutine 退出时通知还没有写入连接的数据包
+func (q *sendQueue) abort(pending []func(error), err error) {
+	for _, written := range pending {
+		written(err)
+	}
+	// push 在锁内检查 done 并入队，done 关闭后加锁，之后不会再有新的数据包入队
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	for {
+		select {
+		case item := <-q.ch:
+			putFrame(item.frame)
+			if item.written != nil {
+				item.written(ErrQueueClosed)
+			}
+		default:
+			return
+		}
+	}
+}
+
+// 按数据包的链路类型选择发送队列
+// UpLink/DownLink 优先使用主链路/从链路，不可用时使用另一条链路；UpLinkOnly/DownLinkOnly 只使用对应的链路
+func selectQueue(lt jt809.LinkType, upq, downq *sendQueue) *sendQueue {
+	switch lt {
+	case jt809.DownLinkOnly:
+		return downq
+	case jt809.UpLinkOnly:
+		return upq
+	case jt809.DownLink:
+		if downq == nil {
+			return upq
+		}
+		return downq
+	case jt809.UpLink:
+		if upq == nil {
+			return downq
+		}
+		return upq
+	}
+	return nil
+}
+
+func (q *sendQueue) close() {
+	q.closeOnce.Do(func() { close(q.done) })
+}
@@ -0,0 +1,112 @@
+package jt809server
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/lai323/jt809server/jt809"
+)
+
+func frameEncoder(b ...byte) func(*jt809.Encoder, []byte) ([]byte, error) {
+	return func(_ *jt809.Encoder, dst []byte) ([]byte, error) { return append(dst, b...), nil }
+}
+
+func TestSendQueuePolicy(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	q := newSendQueue("test", c1, 2, QueueError, log.NewNopLogger(), nil)
+	defer q.close()
+
+	var err error
+	for i := 0; i < 10 && err == nil; i++ {
+		err = q.push(frameEncoder(byte(i)))
+	}
+	if err != ErrQueueFull {
+		t.Fatal("send queue should be full", err)
+	}
+
+	q.close()
+	if err := q.push(frameEncoder(0)); err != ErrQueueClosed {
+		t.Error("closed send queue should return ErrQueueClosed", err)
+	}
+}
+
+func TestSendQueueDropOldest(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	q := newSendQueue("test", c1, 2, QueueDropOldest, log.NewNopLogger(), nil)
+	defer q.close()
+
+	// 第一个数据包被写入 goroutine 取走并阻塞在 Write 上，队列满时丢弃最早的
+	if err := q.push(frameEncoder(0)); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 1)
+	if _, err := io.ReadFull(c2, buf); err != nil || buf[0] != 0 {
+		t.Fatal("read first frame error", buf, err)
+	}
+	for i := 1; i <= 5; i++ {
+		if err := q.push(frameEncoder(byte(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 最多一个数据包正在写入，加上队列中保留的两个
+	var got []byte
+	for len(got) == 0 || got[len(got)-1] != 5 {
+		if _, err := io.ReadFull(c2, buf); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, buf[0])
+	}
+	if len(got) > 3 {
+		t.Error("drop oldest error", got)
+	}
+}
+
+func TestSendQueueWritten(t *testing.T) {
+	c1, c2 := net.Pipe()
+	q := newSendQueue("test", c1, 4, QueueBlock, log.NewNopLogger(), nil)
+	defer q.close()
+
+	results := make(chan error, 3)
+	written := func(err error) { results <- err }
+	if err := q.pushNotify(frameEncoder(0), written); err != nil {
+		t.Fatal(err)
+	}
+
+	// 对端读取之前不会通知
+	select {
+	case err := <-results:
+		t.Fatal("written should wait for the write", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	buf := make([]byte, 1)
+	if _, err := io.ReadFull(c2, buf); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-results; err != nil {
+		t.Error("frame should be written", err)
+	}
+
+	// 连接断开后，正在写入和队列中的数据包都通知错误
+	for i := byte(1); i < 3; i++ {
+		if err := q.pushNotify(frameEncoder(i), written); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c2.Close()
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-results:
+			if err == nil {
+				t.Error("frame should not be written after the link is closed")
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatal("written should be called when the link is closed")
+		}
+	}
+}
@@ -1,6 +1,8 @@
 package jt809server
 
 import (
+	"context"
+	"crypto/tls"
 	"fmt"
 	"io"
 	"net"
@@ -13,70 +15,235 @@ import (
 	"github.com/go-kit/log/level"
 )
 
+// 建立主链路连接，*net.Dialer 和 golang.org/x/net/proxy 的 SOCKS5 Dialer 都实现了这个接口
+type Dialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// 监听从链路端口，签名和 net.Listen 相同
+type ListenFunc func(network, address string) (net.Listener, error)
+
 type Server struct {
 	UserID       uint32
 	Password     string
 	GNSSCenterID uint32
 	UpLinkIP     string
 	UpLinkPort   uint16
-	DownLinkIP   string
+	DownLinkIP   string // 登录时告知上级平台的从链路地址
 	DownLinkPort uint16
 
-	upconn   net.Conn
-	downconn net.Conn
+	// 从链路监听的本地地址，默认监听所有地址
+	DownLinkBindIP string
+	// 建立主链路连接，默认使用 net.Dialer，可以替换为绑定本地地址或者经过代理的 Dialer
+	Dialer Dialer
+	// 监听从链路端口，默认使用 net.Listen
+	Listen ListenFunc
+
+	// 不为空时主链路使用 TLS 连接上级平台，双向认证时在 Certificates 中设置客户端证书
+	UpLinkTLSConfig *tls.Config
+	// 不为空时从链路使用 TLS 监听，双向认证时设置 ClientAuth 和 ClientCAs
+	DownLinkTLSConfig *tls.Config
+
+	// 收到的数据包的分发方式，默认 DispatchOrdered
+	DispatchMode DispatchMode
+	// 处理数据包的 worker 数量，默认 16
+	DispatchWorkers int
+	// 有序分发时每个 worker 的队列长度，默认 64
+	DispatchQueueSize int
+
+	// 每条链路发送队列的长度，默认 1024
+	SendQueueSize int
+	// 发送队列满时的处理方式，默认 QueueBlock
+	SendQueuePolicy QueuePolicy
+
+	// 协议版本，默认 jt809.Protocol2011
+	Protocol jt809.Protocol
+	// 发送的协议版本号，为空时使用 Protocol.Version()，和 Protocol 不兼容时 Serve 返回 *jt809.VersionMismatchErr
+	// 收到的版本号不兼容时丢弃数据包
+	Version []byte
+
+	// 报文加密配置
+	Encrypt EncryptConfig
+	// 收到的帧的最大长度，默认 jt809.DefaultMaxFrameSize
+	MaxFrameSize int
+	// 校验码算法，默认使用标准规定的 jt809.CRC16CCITTFalse
+	CRC16 *jt809.CRC16
+	// 收到的数据包的长度校验方式，默认 jt809.ValidateLenient
+	Validation jt809.Validation
+	// 丢弃无法解码的帧或者数据包时调用，丢弃之后继续读取这条链路
+	OnDrop DropFunc
+
+	// 链路不可用时暂存上传的数据包，登录成功、从链路重新建立或者发送队列清空后补发，实时定位信息会转换为定位信息补报消息
+	// 主链路断开后不会重连，Serve 也不会返回，暂存的数据包在使用同一个 Spool 的新 Server 登录成功后补发
+	Spool Spool
+
+	upconn    net.Conn
+	downconn  net.Conn
+	downln    net.Listener
+	drops     dropCounter
+	upq       *sendQueue
+	downq     *sendQueue
+	loggedIn  bool
+	replaying bool
+	// 补发期间又有新的补发请求，当前的补发结束后重新开始
+	replayPending bool
+	started       bool
+	closing       bool
 
 	logger      log.Logger
-	receiveChan chan jt809.Packet
+	receiveChan chan received
+	receiveWg   sync.WaitGroup
+	handleDone  chan struct{}
+	logoutChan  chan struct{}
+	mux         *ServeMux
 	sngen       *jt809.SerialNoGenerater
 	mtx         sync.Mutex
 	exitedChan  chan struct{}
+	shutdownMtx sync.Mutex
 
 	OnConnect func()
 }
 
+type received struct {
+	link    string
+	packet  jt809.Packet
+	session *Session // 上级平台模式收到数据包的 Session
+}
+
 func NewServer(logger log.Logger) *Server {
-	return &Server{
+	srv := &Server{
 		logger:      logger,
-		receiveChan: make(chan jt809.Packet),
+		receiveChan: make(chan received),
+		handleDone:  make(chan struct{}),
+		logoutChan:  make(chan struct{}, 1),
+		mux:         NewServeMux(),
 		sngen:       jt809.NewSerialNoGenerater(),
 		exitedChan:  make(chan struct{}),
 	}
+	srv.mux.NotFound = srv.onUnsupport
+	// 链路管理的默认处理，可以通过 HandleFunc 替换
+	srv.mux.HandleFunc(jt809.UP_CONNECT_RSP, AnySubType, srv.onUpConnectRsp)
+	srv.mux.HandleFunc(jt809.DOWN_CONNECT_REQ, AnySubType, srv.onDownConnectReq)
+	srv.mux.HandleFunc(jt809.DOWN_LINKTEST_REQ, AnySubType, srv.onDownLinkTestReq)
+	srv.mux.HandleFunc(jt809.UP_LINKTEST_RSP, AnySubType, srv.onUpLinkTestRsp)
+	return srv
+}
+
+// 注册收到的数据包的处理函数，subType 为 AnySubType 时匹配所有子业务类型
+// 替换链路管理的默认处理函数时，可以先通过 Handler 获取默认处理函数再包装
+func (srv *Server) HandleFunc(t, subType uint16, h HandlerFunc) {
+	srv.mux.HandleFunc(t, subType, h)
+}
+
+func (srv *Server) Handler(t, subType uint16) HandlerFunc {
+	return srv.mux.Handler(t, subType)
+}
+
+func (srv *Server) Use(mws ...Middleware) {
+	srv.mux.Use(mws...)
+}
+
+// 发送数据包，返回的错误可能是 ErrServerClosed、ErrNotLoggedIn、ErrLinkUnavailable、ErrQueueFull、ErrQueueClosed 或者 *EncodeError
+// 设置了 Spool 时，因为链路不可用或者队列已满发送失败的数据包会写入 Spool，返回 nil
+func (srv *Server) Send(p jt809.Packet) error {
+	srv.mtx.Lock()
+	loggedIn, closing := srv.loggedIn, srv.closing
+	srv.mtx.Unlock()
+	if closing {
+		return ErrServerClosed
+	}
+
+	var err error
+	if !loggedIn {
+		err = ErrNotLoggedIn
+	} else {
+		err = srv.send(p)
+	}
+	if err != nil && srv.Spool != nil && spoolable(err) {
+		return srv.spool(p)
+	}
+	return err
+}
+
+func (srv *Server) UpRealLocation(loc *jt809.UpExgMsg) error {
+	return srv.Send(loc)
+}
+
+type Status struct {
+	UpLink   bool // 主链路可用
+	DownLink bool // 从链路可用
+	LoggedIn bool // 主链路已登录
+	Closed   bool // 已经调用了 Shutdown
+}
+
+func (srv *Server) Status() Status {
+	srv.mtx.Lock()
+	defer srv.mtx.Unlock()
+	return Status{
+		UpLink:   srv.upq != nil,
+		DownLink: srv.downq != nil,
+		LoggedIn: srv.loggedIn,
+		Closed:   srv.closing,
+	}
 }
 
-func (srv *Server) UpRealLocation(loc *jt809.UpExgMsg) {
-	srv.send(loc)
+// 因为解码错误丢弃的帧和数据包数量
+func (srv *Server) Drops() DropCounters {
+	return srv.drops.load()
 }
 
 func (srv *Server) startLinktest(p jt809.Packet) {
+	ticker := time.NewTicker(time.Second * 50)
+	defer ticker.Stop()
 	for {
-		time.Sleep(time.Second * 50)
 		select {
 		case <-srv.exitedChan:
 			return
-		default:
+		case <-ticker.C:
 		}
 		srv.send(p)
 	}
 }
 
-func (srv *Server) waitdowconn(ch chan net.Conn) {
-	addr := fmt.Sprintf(":%d", srv.DownLinkPort)
-	ln, err := net.Listen("tcp", addr)
+// 监听从链路端口直到 Shutdown，上级平台重新连接从链路时替换已经断开的从链路
+// 第一条从链路建立后向 ch 发送 nil，监听失败时发送错误
+func (srv *Server) serveDownLink(ch chan error) {
+	listen := srv.Listen
+	if listen == nil {
+		listen = net.Listen
+	}
+	addr := net.JoinHostPort(srv.DownLinkBindIP, fmt.Sprint(srv.DownLinkPort))
+	ln, err := listen("tcp", addr)
 	if err != nil {
-		level.Error(srv.logger).Log("msg", "waitdowconn Listen", "error", err)
-		close(ch)
+		level.Error(srv.logger).Log("msg", "serveDownLink Listen", "error", err)
+		ch <- err
+		return
+	}
+	if srv.DownLinkTLSConfig != nil {
+		ln = tls.NewListener(ln, srv.DownLinkTLSConfig)
+	}
+
+	srv.mtx.Lock()
+	if srv.closing {
+		srv.mtx.Unlock()
+		ln.Close()
+		ch <- ErrServerClosed
 		return
 	}
+	srv.downln = ln
+	srv.mtx.Unlock()
 
-	var tempDelay time.Duration
+	var (
+		tempDelay time.Duration
+		connected bool
+	)
 	for {
-		level.Debug(srv.logger).Log("msg", "waitdowconn wait connect", "Addr", ln.Addr())
+		level.Debug(srv.logger).Log("msg", "serveDownLink wait connect", "Addr", ln.Addr())
 		conn, err := ln.Accept()
 
 		if err != nil {
 			select {
 			case <-srv.exitedChan:
-				close(ch)
 				return
 			default:
 			}
@@ -100,12 +267,47 @@ func (srv *Server) waitdowconn(ch chan net.Conn) {
 			level.Error(srv.logger).Log(
 				"msg", "dowconnConnet listener Accept error",
 				"error", err)
-			close(ch)
+			if !connected {
+				ch <- err
+			}
 			return
 		}
-		ch <- conn
-		return
+		tempDelay = 0
+
+		if srv.setDownConn(conn) && !connected {
+			connected = true
+			ch <- nil
+		}
+	}
+}
+
+// 使用新建立的从链路，已有可用的从链路时拒绝新的连接
+func (srv *Server) setDownConn(conn net.Conn) bool {
+	srv.mtx.Lock()
+	defer srv.mtx.Unlock()
+	if srv.closing {
+		conn.Close()
+		return false
+	}
+	if srv.downq != nil {
+		level.Warn(srv.logger).Log("msg", "Server downconn already connected, reject", "remote", conn.RemoteAddr())
+		conn.Close()
+		return false
+	}
+	if srv.downconn != nil {
+		srv.downconn.Close()
+	}
+	level.Info(srv.logger).Log("msg", "Server downconn connected", "remote", conn.RemoteAddr())
+	srv.downconn = conn
+	srv.downq = newSendQueue("downconn", conn, srv.SendQueueSize, srv.SendQueuePolicy, srv.logger, srv.queueRoom, srv.codecOptions()...)
+	// closing 为 false 时 Shutdown 还没有等待 receiveWg
+	srv.receiveWg.Add(1)
+	safego(func() { defer srv.receiveWg.Done(); srv.receive(conn, "downconn") }, srv.logger, "downconn receive panic")
+	// 从链路不可用期间写入 Spool 的数据包
+	if srv.loggedIn {
+		safego(srv.replaySpool, srv.logger, "replay spool panic")
 	}
+	return true
 }
 
 func (srv *Server) login() {
@@ -117,48 +319,68 @@ func (srv *Server) login() {
 	srv.send(req)
 }
 
-func (srv *Server) connect() bool {
+func (srv *Server) connect(ctx context.Context) error {
 	// 等待建立从链路
-	ch := make(chan net.Conn)
-	safego(func() { srv.waitdowconn(ch) }, srv.logger, "waitdowconn panic")
+	ch := make(chan error, 1)
+	safego(func() { srv.serveDownLink(ch) }, srv.logger, "serveDownLink panic")
 
 	// 建立主链路
-	addr := fmt.Sprintf("%s:%d", srv.UpLinkIP, srv.UpLinkPort)
-	conn, err := net.Dial("tcp", addr)
+	addr := net.JoinHostPort(srv.UpLinkIP, fmt.Sprint(srv.UpLinkPort))
+	var dialer Dialer = &net.Dialer{}
+	if srv.Dialer != nil {
+		dialer = srv.Dialer
+	}
+	upconn, err := dialer.DialContext(ctx, "tcp", addr)
 	if err != nil {
 		level.Error(srv.logger).Log("msg", "connect Dial", "error", err)
-		return false
+		return err
+	}
+	if srv.UpLinkTLSConfig != nil {
+		upconn, err = tlsClient(ctx, upconn, srv.UpLinkTLSConfig, srv.UpLinkIP)
+		if err != nil {
+			level.Error(srv.logger).Log("msg", "connect TLS handshake", "error", err)
+			return err
+		}
 	}
 
-	// 启动主链路消息接收
-	srv.upconn = conn
+	// 启动主链路消息接收，连接期间已经调用了 Shutdown 时关闭新的连接
+	srv.mtx.Lock()
+	if srv.closing {
+		srv.mtx.Unlock()
+		upconn.Close()
+		return ErrServerClosed
+	}
+	srv.upconn = upconn
+	srv.upq = newSendQueue("upconn", upconn, srv.SendQueueSize, srv.SendQueuePolicy, srv.logger, srv.queueRoom, srv.codecOptions()...)
+	// closing 为 false 时 Shutdown 还没有等待 receiveWg
+	srv.receiveWg.Add(1)
+	srv.mtx.Unlock()
 	srv.login()
-	safego(func() { srv.receive(srv.upconn, "upconn") }, srv.logger, "upconn receive panic")
-
-	// 启动消息处理
-	safego(func() { defer srv.Shutdown(); srv.handle() }, srv.logger, "handle panic")
+	safego(func() { defer srv.receiveWg.Done(); srv.receive(upconn, "upconn") }, srv.logger, "upconn receive panic")
 
-	// 启动从链路消息接收
-	var ok bool
 	select {
-	case conn, ok = <-ch:
-		if !ok {
-			return false
+	case err = <-ch:
+		if err != nil {
+			return fmt.Errorf("jt809server downconn listen failed: %s", err)
 		}
+		return nil
 	case <-srv.exitedChan:
-		return false
+		return ErrServerClosed
+	case <-ctx.Done():
+		return ctx.Err()
 	}
-
-	srv.downconn = conn
-	safego(func() { srv.receive(srv.downconn, "downconn") }, srv.logger, "downconn receive panic")
-	return true
 }
 
 func (srv *Server) receive(conn net.Conn, connname string) {
 	level.Debug(srv.logger).Log("msg", "start receive", "conn", connname)
-	dec := jt809.NewDecoder(conn)
+	dec := jt809.NewDecoder(conn, srv.codecOptions()...)
 	for {
 		p, err := dec.Decode()
+		if de, ok := err.(*jt809.DecodeError); ok && de.Recoverable() {
+			ctx := &Context{Context: context.Background(), Link: connname, srv: srv}
+			drop(&srv.drops, srv.OnDrop, ctx, de, srv.logger)
+			continue
+		}
 		if err != nil {
 			select {
 			case <-srv.exitedChan:
@@ -169,82 +391,153 @@ func (srv *Server) receive(conn net.Conn, connname string) {
 			if err != io.EOF {
 				level.Error(srv.logger).Log("msg", "Server receive Decode error", "error", err)
 			}
-			break
+			srv.linkDown(connname, conn)
+			return
 		}
 		level.Debug(srv.logger).Log("msg", "receive", "conn", connname, "packet", p)
-		srv.receiveChan <- p
+		if err := srv.Protocol.ValidVersion(p.Header().Version); err != nil {
+			level.Error(srv.logger).Log("msg", "Server receive drop packet", "conn", connname, "packet", p, "error", err)
+			continue
+		}
+		if rsp, ok := p.(*jt809.UpConnectRsp); ok {
+			// 在分发之前记录登录状态，替换默认的处理函数不影响发送
+			srv.mtx.Lock()
+			srv.loggedIn = rsp.Result == 0
+			srv.mtx.Unlock()
+			if rsp.Result == 0 {
+				safego(srv.replaySpool, srv.logger, "replay spool panic")
+			}
+		}
+		if _, ok := p.(*jt809.UpDisconnectRsp); ok {
+			select {
+			case srv.logoutChan <- struct{}{}:
+			default:
+			}
+		}
+
+		// 关闭后不再分发收到的数据包，receiveChan 在所有 receive 退出之后才会关闭
+		select {
+		case srv.receiveChan <- received{link: connname, packet: p}:
+		case <-srv.exitedChan:
+			return
+		}
 	}
 }
 
-func (srv *Server) send(p jt809.Packet) {
+// 链路断开后不再使用这条链路发送，之后上传的数据包会写入 Spool
+// conn 已经被新的从链路替换时不做处理
+func (srv *Server) linkDown(connname string, conn net.Conn) {
 	srv.mtx.Lock()
 	defer srv.mtx.Unlock()
-	lt := p.LinkType()
-	var conn net.Conn = nil
-	var connname string
-
-	if lt == jt809.DownLinkOnly && srv.downconn == nil {
-		level.Error(srv.logger).Log(
-			"msg", "Server send downconn unavailable", "packet", p)
-		return
-	}
-	if lt == jt809.UpLinkOnly && srv.upconn == nil {
-		level.Error(srv.logger).Log(
-			"msg", "Server send upconn unavailable", "packet", p)
-		return
+	switch connname {
+	case "upconn":
+		if srv.upconn != conn {
+			return
+		}
+		srv.loggedIn = false
+		if srv.upq != nil {
+			srv.upq.close()
+			srv.upq = nil
+		}
+	case "downconn":
+		if srv.downconn != conn {
+			return
+		}
+		if srv.downq != nil {
+			srv.downq.close()
+			srv.downq = nil
+		}
+		srv.downconn.Close()
+		srv.downconn = nil
 	}
+}
 
-	if lt == jt809.DownLinkOnly {
-		connname = "downconn"
-		conn = srv.downconn
-	}
-	if lt == jt809.UpLinkOnly {
-		connname = "upconn"
-		conn = srv.upconn
-	}
+func (srv *Server) send(p jt809.Packet) error {
+	return srv.sendNotify(p, nil)
+}
 
-	if lt == jt809.DownLink {
-		connname = "downconn"
-		conn = srv.downconn
-		if conn == nil {
-			connname = "upconn"
-			conn = srv.upconn
-		}
+// 发送数据包，入队成功后在写入连接或者发送失败时调用 written，见 sendQueue.pushNotify
+func (srv *Server) sendNotify(p jt809.Packet, written func(error)) error {
+	srv.mtx.Lock()
+	q := selectQueue(p.LinkType(), srv.upq, srv.downq)
+	srv.mtx.Unlock()
+
+	if q == nil {
+		level.Error(srv.logger).Log("msg", "Server send not connect available", "packet", p)
+		return ErrLinkUnavailable
 	}
-	if lt == jt809.UpLink {
-		connname = "upconn"
-		conn = srv.upconn
-		if conn == nil {
-			connname = "downconn"
-			conn = srv.downconn
+
+	err := q.pushNotify(func(enc *jt809.Encoder, dst []byte) ([]byte, error) {
+		h := p.Header()
+		h.SerialNo = srv.sngen.GetByType(h.Type)
+		h.GNSSCenterID = srv.GNSSCenterID
+		setHeaderVersion(h, srv.Protocol, srv.Version)
+		srv.Encrypt.setHeader(h)
+		b, err := enc.Append(dst, p)
+		if err != nil {
+			return b, &EncodeError{Packet: p, Err: err}
 		}
+		return b, nil
+	}, written)
+	if err != nil {
+		level.Error(srv.logger).Log("msg", "Server send", "conn", q.name, "packet", p, "error", err)
+		return err
 	}
+	level.Debug(srv.logger).Log("msg", "send", "conn", q.name, "packet", p)
+	return nil
+}
 
-	if conn == nil {
-		level.Error(srv.logger).Log("msg", "Server send not connect available", "packet", p)
-	}
+// 发送队列返回过 ErrQueueFull 之后又清空了，补发期间写入 Spool 的数据包
+func (srv *Server) queueRoom() {
+	safego(srv.replaySpool, srv.logger, "replay spool panic")
+}
 
-	h := p.Header()
-	h.SerialNo = srv.sngen.GetByType(h.Type)
-	h.GNSSCenterID = srv.GNSSCenterID
-	h.Version = []byte{1, 0, 0}
-	h.Encrypt = 0
-	h.EncryptKey = 0
+func (srv *Server) codecOptions() []jt809.Option {
+	return append(srv.Encrypt.options(),
+		jt809.WithProtocol(srv.Protocol),
+		jt809.WithMaxFrameSize(srv.MaxFrameSize),
+		jt809.WithCRC16(srv.CRC16),
+		jt809.WithValidation(srv.Validation))
+}
 
-	err := jt809.NewEncoder(conn).Encode(p)
-	if err != nil {
-		level.Error(srv.logger).Log("msg", "Server send Encode", "packet", p)
+// 设置发送的协议版本号，2019 版本同时设置发送时间
+func setHeaderVersion(h *jt809.Header, protocol jt809.Protocol, version []byte) {
+	if len(version) == 0 {
+		version = protocol.Version()
+	}
+	h.Version = version
+	h.Time = 0
+	if protocol == jt809.Protocol2019 {
+		h.Time = uint64(time.Now().Unix())
 	}
-	level.Debug(srv.logger).Log("msg", "send", "conn", connname, "packet", p)
 }
 
-func (srv *Server) Serve() error {
+// 建立主从链路并登录，直到 Shutdown 或者 ctx 结束时返回
+// ctx 结束时不会等待发送队列和数据包处理完成，需要优雅退出时调用 Shutdown
+func (srv *Server) Serve(ctx context.Context) error {
 	level.Debug(srv.logger).Log("msg", "Server start")
+	if len(srv.Version) > 0 {
+		if err := srv.Protocol.ValidVersion(srv.Version); err != nil {
+			level.Error(srv.logger).Log("msg", "Server Version", "error", err)
+			return err
+		}
+	}
+	srv.mtx.Lock()
+	if srv.closing || srv.started {
+		srv.mtx.Unlock()
+		return ErrServerClosed
+	}
+	srv.started = true
+	srv.mtx.Unlock()
+	safego(func() { defer close(srv.handleDone); srv.handle() }, srv.logger, "handle panic")
 
-	ok := srv.connect()
-	if !ok {
-		srv.Shutdown()
-		return nil
+	err := srv.connect(ctx)
+	if err != nil {
+		srv.Shutdown(ctx)
+		if err == ErrServerClosed {
+			return nil
+		}
+		return err
 	}
 
 	if srv.OnConnect != nil {
@@ -261,80 +554,173 @@ func (srv *Server) Serve() error {
 		}()
 	}
 
-	<-srv.exitedChan
-	return nil
+	select {
+	case <-srv.exitedChan:
+		return nil
+	case <-ctx.Done():
+		srv.Shutdown(ctx)
+		return ctx.Err()
+	}
 }
 
-func (srv *Server) Shutdown() {
+// 主链路注销时等待应答的最长时间
+const logoutTimeout = 5 * time.Second
+
+// 优雅关闭：不再接受新的发送，发送完队列中的数据包，注销主链路，关闭链路，等待处理中的数据包处理完成
+// ctx 结束时直接关闭链路并返回 ctx.Err()
+func (srv *Server) Shutdown(ctx context.Context) error {
+	srv.shutdownMtx.Lock()
+	defer srv.shutdownMtx.Unlock()
+
+	srv.mtx.Lock()
+	if srv.closing {
+		srv.mtx.Unlock()
+		return nil
+	}
+	srv.closing = true
+	loggedIn, started := srv.loggedIn, srv.started
+	srv.mtx.Unlock()
+
+	// 停止链路保持、补发等后台任务，不再分发收到的数据包
+	close(srv.exitedChan)
+
+	srv.drain(ctx)
+	if loggedIn && ctx.Err() == nil {
+		srv.logout(ctx)
+	}
+
+	srv.mtx.Lock()
+	srv.loggedIn = false
+	if srv.upq != nil {
+		srv.upq.close()
+		srv.upq = nil
+	}
+	if srv.downq != nil {
+		srv.downq.close()
+		srv.downq = nil
+	}
+	if srv.upconn != nil {
+		srv.upconn.Close()
+	}
+	if srv.downconn != nil {
+		srv.downconn.Close()
+	}
+	if srv.downln != nil {
+		srv.downln.Close()
+		srv.downln = nil
+	}
+	srv.mtx.Unlock()
+
+	// 所有 receive 退出后才能关闭 receiveChan，ctx 结束时不再等待，之后由后台 goroutine 关闭
+	finished := make(chan struct{})
+	go func() {
+		srv.receiveWg.Wait()
+		close(srv.receiveChan)
+		close(finished)
+	}()
 	select {
-	case <-srv.exitedChan:
-		// Already closed. Don't close again.
-	default:
-		close(srv.exitedChan)
-		if srv.upconn != nil {
-			srv.upconn.Close()
+	case <-finished:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	if !started {
+		return nil
+	}
+	select {
+	case <-srv.handleDone:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (srv *Server) drain(ctx context.Context) {
+	srv.mtx.Lock()
+	upq, downq := srv.upq, srv.downq
+	srv.mtx.Unlock()
+	for _, q := range []*sendQueue{upq, downq} {
+		if q == nil {
+			continue
 		}
-		if srv.downconn != nil {
-			srv.downconn.Close()
+		err := q.drain(ctx)
+		if err != nil {
+			level.Error(srv.logger).Log("msg", "Server drain", "conn", q.name, "error", err)
 		}
-		close(srv.receiveChan)
+	}
+}
+
+func (srv *Server) logout(ctx context.Context) {
+	req := jt809.NewUpDisconnectReq()
+	req.UserID = srv.UserID
+	req.Password = jt809.FixedLengthString(srv.Password, 8, false)
+	if err := srv.send(req); err != nil {
+		return
+	}
+	srv.drain(ctx)
+
+	timer := time.NewTimer(logoutTimeout)
+	defer timer.Stop()
+	select {
+	case <-srv.logoutChan:
+		level.Info(srv.logger).Log("msg", "logout response")
+	case <-timer.C:
+		level.Error(srv.logger).Log("msg", "Server logout response timeout")
+	case <-ctx.Done():
 	}
 }
 
 func (srv *Server) handle() {
-	for tmp := range srv.receiveChan {
-		handle := func(p jt809.Packet) {
-			defer func() {
-				if err := recover(); err != nil {
+	d := newDispatcher(srv.DispatchMode, srv.DispatchWorkers, srv.DispatchQueueSize, srv.serve)
+	for r := range srv.receiveChan {
+		d.dispatch(r)
+	}
+	d.close()
+}
 
-					level.Error(srv.logger).Log(
-						"msg", "client handle panic",
-						"packet", p,
-						"error", err,
-						"stack", debug.Stack())
-				}
-			}()
+func (srv *Server) serve(r received) {
+	defer func() {
+		if err := recover(); err != nil {
 
-			header := p.Header()
-			switch header.Type {
-			case jt809.UP_CONNECT_RSP:
-				srv.onUpConnectRsp(p.(*jt809.UpConnectRsp))
-			case jt809.DOWN_CONNECT_REQ:
-				srv.onDownConnectReq(p.(*jt809.DownConnectReq))
-			case jt809.DOWN_LINKTEST_REQ:
-				srv.onDownLinkTestReq(p.(*jt809.DownLinkTestReq))
-			case jt809.UP_LINKTEST_RSP:
-				srv.onUpLinkTestRsp(p.(*jt809.UpLinkTestRsp))
-			default:
-				level.Info(srv.logger).Log(
-					"msg", "Server handle unsupport packet", "packet", p)
-			}
+			level.Error(srv.logger).Log(
+				"msg", "client handle panic",
+				"packet", r.packet,
+				"error", err,
+				"stack", debug.Stack())
 		}
-		go handle(tmp)
-	}
+	}()
+
+	ctx := &Context{Context: context.Background(), Link: r.link, srv: srv}
+	srv.mux.ServePacket(ctx, r.packet)
+}
+
+func (srv *Server) onUnsupport(ctx *Context, p jt809.Packet) {
+	level.Info(srv.logger).Log(
+		"msg", "Server handle unsupport packet", "packet", p)
 }
 
-func (srv *Server) onUpConnectRsp(p *jt809.UpConnectRsp) {
+func (srv *Server) onUpConnectRsp(ctx *Context, p jt809.Packet) {
+	rsp := p.(*jt809.UpConnectRsp)
 	level.Info(srv.logger).Log("msg", "login response",
-		"Result", p.Result, "VerifyCode", p.VerifyCode)
+		"Result", rsp.Result, "VerifyCode", rsp.VerifyCode)
 
 	// 如果添加了重连逻辑，注意不要启动多个 link test
 	testp := jt809.NewUpLinkTestReq()
 	safego(func() { srv.startLinktest(testp) }, srv.logger, "upconn linktest panic")
 }
 
-func (srv *Server) onDownConnectReq(p *jt809.DownConnectReq) {
+func (srv *Server) onDownConnectReq(ctx *Context, p jt809.Packet) {
 	rsp := jt809.NewDownConnectRsp()
 	rsp.Result = 0
-	srv.send(rsp)
+	ctx.Reply(rsp)
 }
 
-func (srv *Server) onDownLinkTestReq(p *jt809.DownLinkTestReq) {
+func (srv *Server) onDownLinkTestReq(ctx *Context, p jt809.Packet) {
 	rsp := jt809.NewDownLinkTestRsp()
-	srv.send(rsp)
+	ctx.Reply(rsp)
 }
 
-func (srv *Server) onUpLinkTestRsp(p *jt809.UpLinkTestRsp) {
+func (srv *Server) onUpLinkTestRsp(ctx *Context, p jt809.Packet) {
 }
 
 func safego(goroutine func(), logger log.Logger, errmsg string) {
@@ -0,0 +1,613 @@
+package jt809server
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/lai323/jt809server/jt809"
+)
+
+var errPipeListenerClosed = errors.New("pipe listener closed")
+
+// 内存中的 net.Listener，Accept 返回 conns 中的连接
+type pipeListener struct {
+	conns chan net.Conn
+	done  chan struct{}
+}
+
+func newPipeListener() *pipeListener {
+	return &pipeListener{conns: make(chan net.Conn), done: make(chan struct{})}
+}
+
+func (l *pipeListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, errPipeListenerClosed
+	}
+}
+
+func (l *pipeListener) Close() error {
+	select {
+	case <-l.done:
+	default:
+		close(l.done)
+	}
+	return nil
+}
+
+func (l *pipeListener) Addr() net.Addr {
+	return &net.TCPAddr{}
+}
+
+type pipeDialer chan net.Conn
+
+func (d pipeDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	server, client := net.Pipe()
+	d <- server
+	return client, nil
+}
+
+// 使用内存连接启动 Server 并完成主链路登录，返回上级平台一侧的主链路连接，之后收到注销请求时自动应答
+func startPipeServer(t *testing.T, ln *pipeListener, listenAddr chan string, configure func(srv *Server)) (*Server, net.Conn) {
+	srv, upconn := loginPipeServer(t, ln, listenAddr, configure)
+	// 应答注销请求
+	go func() {
+		dec := jt809.NewDecoder(upconn)
+		for {
+			p, err := dec.Decode()
+			if err != nil {
+				return
+			}
+			if _, ok := p.(*jt809.UpDisconnectReq); ok {
+				upconn.Write(mustMarshal(jt809.NewUpDisconnectRsp()))
+			}
+		}
+	}()
+	return srv, upconn
+}
+
+// 和 startPipeServer 相同，但是登录之后由调用方读取主链路
+func loginPipeServer(t *testing.T, ln *pipeListener, listenAddr chan string, configure func(srv *Server)) (*Server, net.Conn) {
+	dialer := make(pipeDialer, 1)
+	srv := NewServer(log.NewNopLogger())
+	srv.GNSSCenterID = 20180920
+	srv.UpLinkIP = "10.0.0.1"
+	srv.UpLinkPort = 809
+	srv.DownLinkBindIP = "127.0.0.2"
+	srv.DownLinkPort = 8090
+	srv.Dialer = dialer
+	srv.Listen = func(network, address string) (net.Listener, error) {
+		listenAddr <- address
+		return ln, nil
+	}
+	if configure != nil {
+		configure(srv)
+	}
+	go srv.Serve(context.Background())
+
+	upconn := <-dialer
+	p, err := jt809.NewDecoder(upconn).Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := p.(*jt809.UpConnectReq); !ok {
+		t.Fatal("first packet should be UpConnectReq", p)
+	}
+	rsp := jt809.NewUpConnectRsp()
+	rsp.Result = jt809.UpConnectSuccess
+	_, err = upconn.Write(mustMarshal(rsp))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return srv, upconn
+}
+
+func waitStatus(t *testing.T, srv *Server, ok func(Status) bool) {
+	deadline := time.Now().Add(3 * time.Second)
+	for st := srv.Status(); !ok(st); st = srv.Status() {
+		if time.Now().After(deadline) {
+			t.Fatal("wait status timeout", st)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func shutdownServer(t *testing.T, srv *Server) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		t.Error("Shutdown error", err)
+	}
+}
+
+func TestServerDialerListen(t *testing.T) {
+	ln := newPipeListener()
+	listenAddr := make(chan string, 1)
+	srv, upconn := startPipeServer(t, ln, listenAddr, nil)
+	defer upconn.Close()
+
+	if addr := <-listenAddr; addr != "127.0.0.2:8090" {
+		t.Error("down link listen address error", addr)
+	}
+	server, downconn := net.Pipe()
+	defer downconn.Close()
+	ln.conns <- server
+
+	waitStatus(t, srv, func(st Status) bool { return st.LoggedIn && st.UpLink && st.DownLink })
+	shutdownServer(t, srv)
+}
+
+func TestServerDownLinkReconnect(t *testing.T) {
+	ln := newPipeListener()
+	srv, upconn := startPipeServer(t, ln, make(chan string, 1), nil)
+	defer upconn.Close()
+
+	server, downconn := net.Pipe()
+	ln.conns <- server
+	waitStatus(t, srv, func(st Status) bool { return st.DownLink })
+
+	// 已有可用的从链路时拒绝新的连接
+	server, duplicate := net.Pipe()
+	ln.conns <- server
+	duplicate.SetReadDeadline(time.Now().Add(3 * time.Second))
+	if _, err := duplicate.Read(make([]byte, 1)); err != io.EOF {
+		t.Error("duplicate downconn should be closed", err)
+	}
+	if !srv.Status().DownLink {
+		t.Error("duplicate downconn should not replace the active one")
+	}
+
+	// 从链路断开后接受重新连接
+	downconn.Close()
+	waitStatus(t, srv, func(st Status) bool { return !st.DownLink })
+	server, downconn = net.Pipe()
+	defer downconn.Close()
+	ln.conns <- server
+	waitStatus(t, srv, func(st Status) bool { return st.DownLink })
+
+	linktest := jt809.NewDownLinkTestReq()
+	_, err := downconn.Write(mustMarshal(linktest))
+	if err != nil {
+		t.Fatal(err)
+	}
+	downconn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	p, err := jt809.NewDecoder(downconn).Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := p.(*jt809.DownLinkTestRsp); !ok {
+		t.Error("should receive DownLinkTestRsp on new downconn", p)
+	}
+
+	shutdownServer(t, srv)
+	select {
+	case <-ln.done:
+	default:
+		t.Error("down link listener should be closed by Shutdown")
+	}
+}
+
+func TestServerDropFrame(t *testing.T) {
+	ln := newPipeListener()
+	drops := make(chan *jt809.DecodeError, 2)
+	srv, upconn := startPipeServer(t, ln, make(chan string, 1), func(srv *Server) {
+		srv.OnDrop = func(ctx *Context, err *jt809.DecodeError) {
+			if ctx.Link != "downconn" {
+				t.Error("OnDrop link error", ctx.Link)
+			}
+			drops <- err
+		}
+	})
+	defer upconn.Close()
+
+	server, downconn := net.Pipe()
+	defer downconn.Close()
+	ln.conns <- server
+	waitStatus(t, srv, func(st Status) bool { return st.DownLink })
+
+	badcrc := mustMarshal(jt809.NewDownLinkTestReq())
+	badcrc[len(badcrc)-2] ^= 0xff
+	// 子业务数据长度超过数据体
+	overflow := make([]byte, 21+1+2+4)
+	binary.BigEndian.PutUint16(overflow[22:], jt809.UP_EXG_MSG_REAL_LOCATION)
+	binary.BigEndian.PutUint32(overflow[24:], 100)
+	short := jt809.NewRawPacket(jt809.UP_EXG_MSG, overflow)
+	for _, frame := range [][]byte{badcrc, mustMarshal(short), mustMarshal(jt809.NewDownLinkTestReq())} {
+		if _, err := downconn.Write(frame); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	downconn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	p, err := jt809.NewDecoder(downconn).Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := p.(*jt809.DownLinkTestRsp); !ok {
+		t.Error("link should keep reading after decode errors", p)
+	}
+	for _, kind := range []jt809.DecodeErrorKind{jt809.FrameError, jt809.PacketError} {
+		if err := <-drops; err.Kind != kind {
+			t.Error("drop kind error", err)
+		}
+	}
+	if c := srv.Drops(); c.Frames != 1 || c.Packets != 1 {
+		t.Error("drop counters error", c)
+	}
+	shutdownServer(t, srv)
+}
+
+func TestServerShutdown(t *testing.T) {
+	ln := newPipeListener()
+	handling, release := make(chan struct{}), make(chan struct{})
+	defer close(release)
+	srv, upconn := loginPipeServer(t, ln, make(chan string, 1), func(srv *Server) {
+		srv.HandleFunc(jt809.DOWN_TOTAL_RECV_BACK_MSG, AnySubType, func(ctx *Context, p jt809.Packet) {
+			close(handling)
+			<-release
+		})
+	})
+	defer upconn.Close()
+	server, downconn := net.Pipe()
+	defer downconn.Close()
+	ln.conns <- server
+	waitStatus(t, srv, func(st Status) bool { return st.LoggedIn && st.DownLink })
+
+	// 处理中的数据包阻塞到 Shutdown 超时
+	if _, err := downconn.Write(mustMarshal(jt809.NewDownTotalRecvBackMsg())); err != nil {
+		t.Fatal(err)
+	}
+	<-handling
+
+	// 没有读取主链路，数据包留在发送队列中
+	for i := 0; i < 3; i++ {
+		if err := srv.Send(jt809.NewUpLinkTestReq()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	deadline := time.Now().Add(time.Second)
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	shutdown := make(chan error, 1)
+	go func() { shutdown <- srv.Shutdown(ctx) }()
+
+	waitStatus(t, srv, func(st Status) bool { return st.Closed })
+	if err := srv.Send(jt809.NewUpLinkTestReq()); err != ErrServerClosed {
+		t.Error("Send after Shutdown should return ErrServerClosed", err)
+	}
+
+	// 先发送完队列中的数据包，再注销主链路
+	upconn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	dec := jt809.NewDecoder(upconn)
+	for i := 0; i < 4; i++ {
+		p, err := dec.Decode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, logout := p.(*jt809.UpDisconnectReq)
+		if logout != (i == 3) {
+			t.Fatal("packets should be drained before UpDisconnectReq", i, p)
+		}
+	}
+	if _, err := upconn.Write(mustMarshal(jt809.NewUpDisconnectRsp())); err != nil {
+		t.Fatal(err)
+	}
+
+	// 等待处理函数直到 ctx 结束
+	select {
+	case err := <-shutdown:
+		if err != context.DeadlineExceeded {
+			t.Error("Shutdown should return ctx error", err)
+		}
+		if time.Now().Before(deadline) {
+			t.Error("Shutdown should wait for handlers until deadline")
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("Shutdown should return on ctx deadline")
+	}
+}
+
+// 启动 Server 并建立从链路，返回上级平台一侧的从链路连接
+func startPipeDownLink(t *testing.T, configure func(srv *Server)) (*Server, net.Conn, func()) {
+	ln := newPipeListener()
+	srv, upconn := startPipeServer(t, ln, make(chan string, 1), configure)
+	server, downconn := net.Pipe()
+	ln.conns <- server
+	waitStatus(t, srv, func(st Status) bool { return st.LoggedIn && st.DownLink })
+	downconn.SetDeadline(time.Now().Add(3 * time.Second))
+	return srv, downconn, func() {
+		shutdownServer(t, srv)
+		downconn.Close()
+		upconn.Close()
+	}
+}
+
+func writePacket(t *testing.T, conn net.Conn, p jt809.Packet) {
+	if _, err := conn.Write(mustMarshal(p)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testLocation() *jt809.UpExgMsg {
+	p := jt809.NewUpExgMsg()
+	p.VehicleNo = jt809.FixedLengthString("A12345", 21, true)
+	loc := jt809.NewUpExgMsgRealLocation()
+	loc.Date = make([]byte, 4)
+	loc.Time = make([]byte, 3)
+	p.SetSubPacket(loc)
+	return p
+}
+
+func TestServerHandleFunc(t *testing.T) {
+	// 按数据包记录调用顺序，登录应答等其他数据包也会经过中间件
+	var (
+		mtx    sync.Mutex
+		traces = map[jt809.Packet][]string{}
+		calls  = make(chan []string, 1)
+	)
+	record := func(p jt809.Packet, name string) {
+		mtx.Lock()
+		traces[p] = append(traces[p], name)
+		mtx.Unlock()
+	}
+	handler := func(name string) HandlerFunc {
+		return func(ctx *Context, p jt809.Packet) {
+			record(p, name)
+			mtx.Lock()
+			calls <- traces[p]
+			mtx.Unlock()
+		}
+	}
+	middleware := func(name string) Middleware {
+		return func(next HandlerFunc) HandlerFunc {
+			return func(ctx *Context, p jt809.Packet) {
+				record(p, name)
+				next(ctx, p)
+			}
+		}
+	}
+	srv, downconn, stop := startPipeDownLink(t, func(srv *Server) {
+		srv.HandleFunc(jt809.UP_EXG_MSG, jt809.UP_EXG_MSG_REAL_LOCATION, handler("location"))
+		srv.HandleFunc(jt809.UP_EXG_MSG, AnySubType, handler("exgmsg"))
+		srv.HandleFunc(jt809.DOWN_TOTAL_RECV_BACK_MSG, AnySubType, handler("total"))
+		// 先添加的中间件在外层
+		srv.Use(middleware("first"), middleware("second"))
+	})
+	defer stop()
+
+	register := jt809.NewUpExgMsg()
+	register.VehicleNo = jt809.FixedLengthString("A12345", 21, true)
+	sub := jt809.NewUpExgMsgRegister()
+	sub.PlatformID = make([]byte, 11)
+	sub.ProducerID = make([]byte, 11)
+	sub.TerminalModelType = make([]byte, 8)
+	sub.TerminalID = make([]byte, 7)
+	sub.TerminalSimCode = make([]byte, 12)
+	register.SetSubPacket(sub)
+	for _, c := range []struct {
+		packet jt809.Packet
+		want   []string
+	}{
+		{testLocation(), []string{"first", "second", "location"}},
+		{register, []string{"first", "second", "exgmsg"}},
+		{jt809.NewDownTotalRecvBackMsg(), []string{"first", "second", "total"}},
+	} {
+		writePacket(t, downconn, c.packet)
+		select {
+		case got := <-calls:
+			if !reflect.DeepEqual(got, c.want) {
+				t.Errorf("%s handled by %v, should be %v", c.packet, got, c.want)
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatal("wait handler timeout", c.packet)
+		}
+	}
+
+	// 删除处理函数后交给 NotFound
+	srv.HandleFunc(jt809.DOWN_TOTAL_RECV_BACK_MSG, AnySubType, nil)
+	if srv.Handler(jt809.DOWN_TOTAL_RECV_BACK_MSG, AnySubType) != nil {
+		t.Error("handler should be removed")
+	}
+}
+
+func TestServerRecoverMiddleware(t *testing.T) {
+	returned := make(chan struct{}, 1)
+	handled := make(chan struct{}, 1)
+	panicked := false
+	_, downconn, stop := startPipeDownLink(t, func(srv *Server) {
+		srv.Use(func(next HandlerFunc) HandlerFunc {
+			return func(ctx *Context, p jt809.Packet) {
+				next(ctx, p)
+				if p.Header().Type == jt809.DOWN_TOTAL_RECV_BACK_MSG {
+					returned <- struct{}{}
+				}
+			}
+		}, RecoverMiddleware(log.NewNopLogger()))
+		srv.HandleFunc(jt809.DOWN_TOTAL_RECV_BACK_MSG, AnySubType, func(ctx *Context, p jt809.Packet) {
+			if !panicked {
+				panicked = true
+				panic("handler panic")
+			}
+			handled <- struct{}{}
+		})
+	})
+	defer stop()
+
+	// panic 被 RecoverMiddleware 捕获，外层的中间件正常返回，之后的数据包继续处理
+	for _, wait := range []chan struct{}{returned, handled} {
+		writePacket(t, downconn, jt809.NewDownTotalRecvBackMsg())
+		select {
+		case <-wait:
+		case <-time.After(3 * time.Second):
+			t.Fatal("wait handler timeout")
+		}
+	}
+}
+
+func TestServerOverrideHandler(t *testing.T) {
+	linktests := make(chan struct{}, 1)
+	_, downconn, stop := startPipeDownLink(t, func(srv *Server) {
+		// 包装默认处理函数
+		defaultLinkTest := srv.Handler(jt809.DOWN_LINKTEST_REQ, AnySubType)
+		srv.HandleFunc(jt809.DOWN_LINKTEST_REQ, AnySubType, func(ctx *Context, p jt809.Packet) {
+			linktests <- struct{}{}
+			defaultLinkTest(ctx, p)
+		})
+		// 替换默认处理函数，在处理函数中回复
+		srv.HandleFunc(jt809.DOWN_CONNECT_REQ, AnySubType, func(ctx *Context, p jt809.Packet) {
+			if ctx.Link != "downconn" || ctx.Server() == nil {
+				t.Error("handler context error", ctx.Link)
+			}
+			rsp := jt809.NewDownConnectRsp()
+			rsp.Result = 1
+			if err := ctx.Reply(rsp); err != nil {
+				t.Error("Reply error", err)
+			}
+		})
+	})
+	defer stop()
+	dec := jt809.NewDecoder(downconn)
+
+	writePacket(t, downconn, jt809.NewDownLinkTestReq())
+	p, err := dec.Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := p.(*jt809.DownLinkTestRsp); !ok {
+		t.Error("wrapped default handler should reply DownLinkTestRsp", p)
+	}
+	select {
+	case <-linktests:
+	default:
+		t.Error("wrapper should be called")
+	}
+
+	writePacket(t, downconn, jt809.NewDownConnectReq())
+	p, err = dec.Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rsp, ok := p.(*jt809.DownConnectRsp); !ok || rsp.Result != 1 {
+		t.Error("overridden handler should reply DownConnectRsp with Result 1", p)
+	}
+}
+
+func TestServerSendErrors(t *testing.T) {
+	// 没有建立任何链路，以前会在 NewEncoder(nil) 时 panic
+	srv := NewServer(log.NewNopLogger())
+	if err := srv.send(jt809.NewUpLinkTestReq()); !errors.Is(err, ErrLinkUnavailable) {
+		t.Error("send without connection should return ErrLinkUnavailable", err)
+	}
+	if err := srv.UpRealLocation(testLocation()); !errors.Is(err, ErrNotLoggedIn) {
+		t.Error("UpRealLocation before login should return ErrNotLoggedIn", err)
+	}
+
+	ln := newPipeListener()
+	srv, upconn := loginPipeServer(t, ln, make(chan string, 1), func(srv *Server) {
+		srv.SendQueueSize = 2
+		srv.SendQueuePolicy = QueueError
+	})
+	waitStatus(t, srv, func(st Status) bool { return st.LoggedIn })
+
+	// 从链路没有建立
+	if err := srv.Send(jt809.NewUpDisconnectInform()); !errors.Is(err, ErrLinkUnavailable) {
+		t.Error("Send without down link should return ErrLinkUnavailable", err)
+	}
+
+	// 编码错误
+	bad := testLocation()
+	bad.VehicleNo = []byte("A12345")
+	err := srv.UpRealLocation(bad)
+	var eerr *EncodeError
+	if !errors.As(err, &eerr) || eerr.Packet != bad || eerr.Err == nil {
+		t.Error("UpRealLocation should return *EncodeError", err)
+	}
+
+	// 没有读取主链路，第一个数据包阻塞在写入上，之后队列满
+	err = nil
+	for i := 0; i < 10 && err == nil; i++ {
+		err = srv.UpRealLocation(testLocation())
+	}
+	if !errors.Is(err, ErrQueueFull) {
+		t.Error("UpRealLocation should return ErrQueueFull", err)
+	}
+
+	upconn.Close()
+	waitStatus(t, srv, func(st Status) bool { return !st.UpLink })
+	if err := srv.UpRealLocation(testLocation()); !errors.Is(err, ErrNotLoggedIn) {
+		t.Error("UpRealLocation after link down should return ErrNotLoggedIn", err)
+	}
+	shutdownServer(t, srv)
+	if err := srv.Send(jt809.NewUpLinkTestReq()); !errors.Is(err, ErrServerClosed) {
+		t.Error("Send after Shutdown should return ErrServerClosed", err)
+	}
+}
+
+func TestServerVersion(t *testing.T) {
+	srv := NewServer(log.NewNopLogger())
+	srv.Protocol = jt809.Protocol2011
+	srv.Version = []byte{1, 2, 0}
+	err := srv.Serve(context.Background())
+	var verr *jt809.VersionMismatchErr
+	if !errors.As(err, &verr) {
+		t.Error("Serve should reject Version incompatible with Protocol", err)
+	}
+}
+
+// DialContext 阻塞到 release 关闭，返回的连接的另一端发送到 conns
+type blockingDialer struct {
+	dialing chan struct{}
+	release chan struct{}
+	conns   chan net.Conn
+}
+
+func (d *blockingDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	close(d.dialing)
+	<-d.release
+	server, client := net.Pipe()
+	d.conns <- server
+	return client, nil
+}
+
+func TestServerShutdownWhileDialing(t *testing.T) {
+	dialer := &blockingDialer{dialing: make(chan struct{}), release: make(chan struct{}), conns: make(chan net.Conn, 1)}
+	ln := newPipeListener()
+	srv := NewServer(log.NewNopLogger())
+	srv.Dialer = dialer
+	srv.Listen = func(network, address string) (net.Listener, error) { return ln, nil }
+	served := make(chan error, 1)
+	go func() { served <- srv.Serve(context.Background()) }()
+
+	<-dialer.dialing
+	shutdownServer(t, srv)
+
+	// Shutdown 之后连接成功，不再使用这条连接
+	close(dialer.release)
+	upconn := <-dialer.conns
+	defer upconn.Close()
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Error("Serve should return nil after Shutdown", err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("Serve should return after Shutdown")
+	}
+	upconn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	if n, err := upconn.Read(make([]byte, 1)); err != io.EOF {
+		t.Error("up link dialed after Shutdown should be closed without login", n, err)
+	}
+	if st := srv.Status(); st.UpLink || st.LoggedIn {
+		t.Error("up link should not be used after Shutdown", st)
+	}
+}
@@ -0,0 +1,394 @@
+package jt809server
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/lai323/jt809server/jt809"
+)
+
+// 链路重新可用时按写入顺序补发
+type Spool interface {
+	// 追加一条记录
+	Append(record []byte) error
+	// 按写入顺序读取最多 n 条未确认的记录，没有记录时返回空 slice
+	Read(n int) ([][]byte, error)
+	// 确认最近一次 Read 返回的前 n 条记录已经发送，确认后不会再被读取
+	// 每条记录写入连接后都会确认，同一次 Read 之后可以多次调用，n 逐次增大
+	Commit(n int) error
+}
+
+const (
+	spoolLogName    = "spool.log"
+	spoolOffsetName = "spool.offset"
+
+	// 单条记录的最大长度，避免文件损坏时读取超大的长度
+	maxSpoolRecordLength = 1 << 20
+)
+
+// 基于本地文件的 Spool
+// 记录按 4 字节长度 + 内容 追加写入 spool.log，已确认的位置保存在 spool.offset
+// 所有记录都确认后清空两个文件
+type FileSpool struct {
+	// 每次写入后是否调用 fsync，关闭后吞吐更高，但系统崩溃时可能丢失最后写入的记录
+	Sync bool
+
+	mtx       sync.Mutex
+	dir       string
+	f         *os.File
+	offset    int64
+	lastRead  []int64 // 最近一次 Read 返回的每条记录结束时的偏移
+	committed int     // 最近一次 Read 返回的记录中已经确认的数量
+}
+
+func OpenFileSpool(dir string) (*FileSpool, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(filepath.Join(dir, spoolLogName), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	var offset int64
+	b, err := ioutil.ReadFile(filepath.Join(dir, spoolOffsetName))
+	if err != nil && !os.IsNotExist(err) {
+		f.Close()
+		return nil, err
+	}
+	if len(b) > 0 {
+		offset, err = strconv.ParseInt(strings.TrimSpace(string(b)), 10, 64)
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("jt809server spool offset file error: %s", err)
+		}
+	}
+	return &FileSpool{Sync: true, dir: dir, f: f, offset: offset}, nil
+}
+
+func (s *FileSpool) Append(record []byte) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	b := make([]byte, 4+len(record))
+	binary.BigEndian.PutUint32(b, uint32(len(record)))
+	copy(b[4:], record)
+	_, err := s.f.Write(b)
+	if err != nil {
+		return err
+	}
+	if s.Sync {
+		return s.f.Sync()
+	}
+	return nil
+}
+
+func (s *FileSpool) Read(n int) ([][]byte, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	s.lastRead = s.lastRead[:0]
+	s.committed = 0
+	r := bufio.NewReader(io.NewSectionReader(s.f, s.offset, 1<<62))
+	end := s.offset
+	var records [][]byte
+	lenbytes := make([]byte, 4)
+	for len(records) < n {
+		_, err := io.ReadFull(r, lenbytes)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		l := binary.BigEndian.Uint32(lenbytes)
+		if l > maxSpoolRecordLength {
+			return nil, fmt.Errorf("jt809server spool record too large %d at %d", l, end)
+		}
+		record := make([]byte, l)
+		_, err = io.ReadFull(r, record)
+		if err != nil {
+			// 最后一条记录没有写完整，等待之后的写入
+			if err == io.ErrUnexpectedEOF {
+				break
+			}
+			return nil, err
+		}
+		end += 4 + int64(l)
+		records = append(records, record)
+		s.lastRead = append(s.lastRead, end)
+	}
+	return records, nil
+}
+
+func (s *FileSpool) Commit(n int) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if n <= s.committed {
+		return nil
+	}
+	if n > len(s.lastRead) {
+		return fmt.Errorf("jt809server spool commit %d records, only %d read", n, len(s.lastRead))
+	}
+	s.offset = s.lastRead[n-1]
+	s.committed = n
+
+	info, err := s.f.Stat()
+	if err != nil {
+		return err
+	}
+	if s.offset >= info.Size() {
+		// 最近一次 Read 的记录已经全部确认，lastRead 中的偏移不会再被使用
+		err = s.f.Truncate(0)
+		if err != nil {
+			return err
+		}
+		s.offset = 0
+	}
+	return writeFileSync(filepath.Join(s.dir, spoolOffsetName), []byte(strconv.FormatInt(s.offset, 10)))
+}
+
+// 写入临时文件并 fsync 后重命名，系统崩溃时不会留下只写了一部分的文件
+func writeFileSync(path string, b []byte) error {
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(b)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func (s *FileSpool) Close() error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.f.Close()
+}
+
+// 每次从 Spool 读取补发的记录数
+const spoolReplayBatch = 100
+
+func spoolable(err error) bool {
+	return err == ErrNotLoggedIn || err == ErrLinkUnavailable || err == ErrQueueClosed || err == ErrQueueFull
+}
+
+func (srv *Server) spool(p jt809.Packet) error {
+	b, err := jt809.Marshal(p)
+	if err != nil {
+		return &EncodeError{Packet: p, Err: err}
+	}
+	err = srv.Spool.Append(b)
+	if err != nil {
+		level.Error(srv.logger).Log("msg", "Server spool Append", "packet", p, "error", err)
+		return err
+	}
+	level.Debug(srv.logger).Log("msg", "spool", "packet", p)
+	return nil
+}
+
+// 补发 Spool 中的数据包，直到 Spool 为空或者发送失败，未确认的记录在下次补发时重新发送
+// 登录成功、从链路重新建立、发送队列清空后调用，正在补发时只做标记，当前的补发结束后重新开始
+func (srv *Server) replaySpool() {
+	srv.mtx.Lock()
+	if srv.Spool == nil || !srv.loggedIn || srv.closing {
+		srv.mtx.Unlock()
+		return
+	}
+	if srv.replaying {
+		srv.replayPending = true
+		srv.mtx.Unlock()
+		return
+	}
+	srv.replaying = true
+	srv.mtx.Unlock()
+
+	for {
+		srv.replay()
+
+		srv.mtx.Lock()
+		if !srv.replayPending || srv.closing {
+			srv.replaying, srv.replayPending = false, false
+			srv.mtx.Unlock()
+			return
+		}
+		srv.replayPending = false
+		srv.mtx.Unlock()
+	}
+}
+
+func (srv *Server) replay() {
+	for {
+		select {
+		case <-srv.exitedChan:
+			return
+		default:
+		}
+
+		records, err := srv.Spool.Read(spoolReplayBatch)
+		if err != nil {
+			level.Error(srv.logger).Log("msg", "Server replay spool Read", "error", err)
+			return
+		}
+		if len(records) == 0 {
+			return
+		}
+		if !srv.replayRecords(records) {
+			return
+		}
+	}
+}
+
+type replayResult struct {
+	index int
+	err   error
+}
+
+// 发送一次 Read 返回的记录，每个数据包写入连接后确认已经连续发送的记录，全部确认时返回 true
+func (srv *Server) replayRecords(records [][]byte) bool {
+	pkts := spooledPackets(records, srv.logger)
+	// 解码失败的记录不会发送，直接视为已经发送
+	sent := make([]bool, len(records))
+	for i := range sent {
+		sent[i] = true
+	}
+	for _, sp := range pkts {
+		for _, i := range sp.records {
+			sent[i] = false
+		}
+	}
+
+	committed := 0
+	commit := func() bool {
+		n := committed
+		for n < len(sent) && sent[n] {
+			n++
+		}
+		if n == committed {
+			return true
+		}
+		if err := srv.Spool.Commit(n); err != nil {
+			level.Error(srv.logger).Log("msg", "Server replay spool Commit", "error", err)
+			return false
+		}
+		committed = n
+		return true
+	}
+	ok := commit()
+
+	results := make(chan replayResult, len(pkts))
+	queued := 0
+	for i, sp := range pkts {
+		i := i
+		err := srv.sendNotify(sp.packet, func(err error) { results <- replayResult{index: i, err: err} })
+		if err != nil {
+			level.Error(srv.logger).Log("msg", "Server replay spool send", "packet", sp.packet, "error", err)
+			ok = false
+			break
+		}
+		queued++
+	}
+	// 入队的数据包都会通知结果，队列关闭时通知 ErrQueueClosed
+	for ; queued > 0; queued-- {
+		r := <-results
+		if r.err != nil {
+			level.Error(srv.logger).Log("msg", "Server replay spool write", "packet", pkts[r.index].packet, "error", r.err)
+			ok = false
+			continue
+		}
+		for _, i := range pkts[r.index].records {
+			sent[i] = true
+		}
+		if !commit() {
+			ok = false
+		}
+	}
+	return ok && committed == len(records)
+}
+
+// 补发的数据包，records 是它包含的记录在 Read 结果中的下标
+type spooledPacket struct {
+	packet  jt809.Packet
+	records []int
+}
+
+// 解码 Spool 中的记录，同一车辆的实时定位信息按顺序合并为定位信息补报消息
+// 其他数据包发送前先发送已经合并的定位信息，保持和写入时相同的顺序
+func spooledPackets(records [][]byte, logger log.Logger) []spooledPacket {
+	var (
+		pkts    []spooledPacket
+		keys    []string
+		batches = map[string]*spooledPacket{}
+	)
+	flush := func(key string) {
+		pkts = append(pkts, *batches[key])
+		delete(batches, key)
+	}
+	flushAll := func() {
+		for _, key := range keys {
+			if batches[key] != nil {
+				flush(key)
+			}
+		}
+		keys = keys[:0]
+	}
+
+	for i, record := range records {
+		p, err := jt809.Unmarshal(record)
+		if err != nil {
+			level.Error(logger).Log("msg", "spooled packet Unmarshal", "error", err)
+			continue
+		}
+		var loc *jt809.UpExgMsgRealLocation
+		exgmsg, ok := p.(*jt809.UpExgMsg)
+		if ok {
+			loc, ok = exgmsg.SubPacket().(*jt809.UpExgMsgRealLocation)
+		}
+		if !ok {
+			flushAll()
+			pkts = append(pkts, spooledPacket{packet: p, records: []int{i}})
+			continue
+		}
+
+		key := exgmsg.VehicleKey()
+		batch := batches[key]
+		if batch == nil {
+			msg := jt809.NewUpExgMsg()
+			msg.VehicleNo = exgmsg.VehicleNo
+			msg.VehicleColor = exgmsg.VehicleColor
+			msg.SetSubPacket(jt809.NewUpExgMsgHistoryLocation())
+			batch = &spooledPacket{packet: msg}
+			batches[key] = batch
+			keys = append(keys, key)
+		}
+		history := batch.packet.(*jt809.UpExgMsg).SubPacket().(*jt809.UpExgMsgHistoryLocation)
+		history.Add(loc)
+		batch.records = append(batch.records, i)
+		if len(history.GNSSData) == jt809.MaxHistoryLocationCount {
+			flush(key)
+		}
+	}
+	flushAll()
+	return pkts
+}
@@ -0,0 +1,185 @@
+package jt809server
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/lai323/jt809server/jt809"
+)
+
+func TestFileSpool(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jt809spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := OpenFileSpool(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := byte(0); i < 5; i++ {
+		if err := s.Append([]byte{i, i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	records, err := s.Read(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(records, [][]byte{{0, 0}, {1, 1}}) {
+		t.Fatal("FileSpool Read error", records)
+	}
+	if err := s.Commit(2); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	// 重新打开后从确认的位置继续读取
+	s, err = OpenFileSpool(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	records, err = s.Read(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(records, [][]byte{{2, 2}, {3, 3}, {4, 4}}) {
+		t.Fatal("FileSpool Read after reopen error", records)
+	}
+	if err := s.Commit(3); err != nil {
+		t.Fatal(err)
+	}
+	records, err = s.Read(10)
+	if err != nil || len(records) != 0 {
+		t.Fatal("FileSpool should be empty", records, err)
+	}
+}
+
+func TestSpooledPackets(t *testing.T) {
+	var records [][]byte
+	for i := 0; i < 7; i++ {
+		for _, vehicle := range []string{"A1", "A2"} {
+			p := jt809.NewUpExgMsg()
+			p.VehicleNo = jt809.FixedLengthString(vehicle, 21, true)
+			p.VehicleColor = jt809.PlateColorYellow
+			loc := jt809.NewUpExgMsgRealLocation()
+			loc.Date = make([]byte, 4)
+			loc.Time = make([]byte, 3)
+			loc.Lon = uint32(i)
+			p.SetSubPacket(loc)
+			records = append(records, mustMarshal(p))
+		}
+	}
+	records = append(records, mustMarshal(jt809.NewUpLinkTestReq()))
+
+	records = append(records, records[0])
+
+	pkts := spooledPackets(records, log.NewNopLogger())
+	var (
+		counts []int
+		first  []int
+	)
+	for _, p := range pkts {
+		first = append(first, p.records[0])
+		exgmsg, ok := p.packet.(*jt809.UpExgMsg)
+		if !ok {
+			counts = append(counts, 0)
+			continue
+		}
+		history := exgmsg.SubPacket().(*jt809.UpExgMsgHistoryLocation)
+		counts = append(counts, int(history.GNSSCount))
+		if len(p.records) != int(history.GNSSCount) {
+			t.Error("spooledPackets records error", p.records)
+		}
+	}
+	// 其他数据包之前的定位信息先发送，之后的定位信息重新合并
+	if !reflect.DeepEqual(counts, []int{5, 5, 2, 2, 0, 1}) || !reflect.DeepEqual(first, []int{0, 1, 10, 11, 14, 15}) {
+		t.Error("spooledPackets error", counts, first)
+	}
+}
+
+func TestServerReplaySpool(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jt809spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	spool, err := OpenFileSpool(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer spool.Close()
+
+	ln := newPipeListener()
+	srv, upconn := startPipeServer(t, ln, make(chan string, 1), func(srv *Server) { srv.Spool = spool })
+	defer upconn.Close()
+	waitStatus(t, srv, func(st Status) bool { return st.LoggedIn })
+
+	// 从链路没有建立，只能通过从链路发送的数据包写入 Spool
+	var want []uint16
+	for i := byte(0); i < 3; i++ {
+		p := jt809.NewUpDisconnectInform()
+		p.ErrorCode = i
+		if err := srv.Send(p); err != nil {
+			t.Fatal(err)
+		}
+		want = append(want, jt809.UP_DISCONNECT_INFORM)
+	}
+	p := jt809.NewUpCloseLinkInform()
+	if err := srv.Send(p); err != nil {
+		t.Fatal(err)
+	}
+	want = append(want, jt809.UP_CLOSELINK_INFORM)
+
+	// 从链路建立后按写入顺序补发
+	server, downconn := net.Pipe()
+	defer downconn.Close()
+	ln.conns <- server
+	downconn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	dec := jt809.NewDecoder(downconn)
+	for i, typ := range want {
+		p, err := dec.Decode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p.Header().Type != typ {
+			t.Fatal("replay packet type error", p)
+		}
+		if inform, ok := p.(*jt809.UpDisconnectInform); ok && inform.ErrorCode != byte(i) {
+			t.Error("replay order error", inform)
+		}
+	}
+
+	// 写入连接后确认，全部确认后清空文件
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		info, err := os.Stat(filepath.Join(dir, spoolLogName))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size() == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("spool should be committed after replay")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	shutdownServer(t, srv)
+}
+
+func mustMarshal(p jt809.Packet) []byte {
+	b, err := jt809.Marshal(p)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
@@ -0,0 +1,649 @@
+package jt809server
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"runtime/debug"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/lai323/jt809server/jt809"
+)
+
+// 验证下级平台的主链路登录请求，返回 UpConnectRsp 的验证结果，例如 jt809.UpConnectSuccess
+// gnssCenterID 是登录请求数据头中的下级平台接入码
+type Authenticator interface {
+	Authenticate(gnssCenterID uint32, req *jt809.UpConnectReq, remoteAddr net.Addr) byte
+}
+
+type AuthenticatorFunc func(gnssCenterID uint32, req *jt809.UpConnectReq, remoteAddr net.Addr) byte
+
+func (f AuthenticatorFunc) Authenticate(gnssCenterID uint32, req *jt809.UpConnectReq, remoteAddr net.Addr) byte {
+	return f(gnssCenterID, req, remoteAddr)
+}
+
+const (
+	// 主链路建立后等待登录请求的最长时间
+	loginTimeout = 30 * time.Second
+	// 从链路连接失败或者断开后重新连接的间隔
+	downLinkRetryInterval = 10 * time.Second
+	// 从链路连接保持请求的发送间隔
+	downLinkTestInterval = 50 * time.Second
+)
+
+// 上级平台服务，监听主链路端口接受下级平台登录，登录成功后连接下级平台的从链路
+// 每个登录成功的下级平台对应一个 Session，收到的数据包分发到 HandleFunc 注册的处理函数
+type SuperiorServer struct {
+	// 主链路监听地址，例如 ":809"
+	Addr string
+	// 不为空时主链路使用 TLS 监听，双向认证时设置 ClientAuth 和 ClientCAs
+	TLSConfig *tls.Config
+	// 不为空时从链路使用 TLS 连接下级平台，双向认证时在 Certificates 中设置客户端证书
+	DownLinkTLSConfig *tls.Config
+	// 验证下级平台登录，必须设置，为空时 Serve 返回 ErrNoAuthenticator，使用账号存储时设置为 AccountAuthenticator(store)
+	Authenticator Authenticator
+	// 同一接入码重复登录时拒绝新的登录，默认关闭旧的 Session 接受新的登录
+	RejectDuplicateLogin bool
+
+	// 收到的数据包的分发方式，默认 DispatchOrdered
+	DispatchMode DispatchMode
+	// 处理数据包的 worker 数量，默认 16
+	DispatchWorkers int
+	// 有序分发时每个 worker 的队列长度，默认 64
+	DispatchQueueSize int
+
+	// 每条链路发送队列的长度，默认 1024
+	SendQueueSize int
+	// 发送队列满时的处理方式，默认 QueueBlock
+	SendQueuePolicy QueuePolicy
+
+	// 协议版本，默认 jt809.Protocol2011，登录请求的版本号不兼容时拒绝登录
+	Protocol jt809.Protocol
+
+	// 报文加密配置
+	Encrypt EncryptConfig
+	// 按接入码返回下级平台使用的加密配置，为空时所有下级平台使用 Encrypt
+	EncryptFor func(gnssCenterID uint32) EncryptConfig
+	// 收到的帧的最大长度，默认 jt809.DefaultMaxFrameSize
+	MaxFrameSize int
+	// 校验码算法，默认使用标准规定的 jt809.CRC16CCITTFalse
+	CRC16 *jt809.CRC16
+	// 收到的数据包的长度校验方式，默认 jt809.ValidateLenient
+	Validation jt809.Validation
+	// 丢弃无法解码的帧或者数据包时调用，丢弃之后继续读取这条链路
+	OnDrop DropFunc
+
+	// 下级平台登录成功并且从链路连接成功后调用
+	OnSession func(s *Session)
+
+	logger   log.Logger
+	mux      *ServeMux
+	mtx      sync.Mutex
+	ln       net.Listener
+	d        *dispatcher
+	sessions map[uint32]*Session
+	wg       sync.WaitGroup
+	closing  bool
+	done     chan struct{}
+}
+
+func NewSuperiorServer(logger log.Logger) *SuperiorServer {
+	srv := &SuperiorServer{
+		logger:   logger,
+		mux:      NewServeMux(),
+		sessions: map[uint32]*Session{},
+		done:     make(chan struct{}),
+	}
+	srv.mux.NotFound = srv.onUnsupport
+	// 链路管理的默认处理，可以通过 HandleFunc 替换
+	srv.mux.HandleFunc(jt809.UP_LINKTEST_REQ, AnySubType, srv.onUpLinkTestReq)
+	srv.mux.HandleFunc(jt809.UP_DISCONNECT_REQ, AnySubType, srv.onUpDisconnectReq)
+	srv.mux.HandleFunc(jt809.DOWN_CONNECT_RSP, AnySubType, srv.onDownConnectRsp)
+	srv.mux.HandleFunc(jt809.DOWN_LINKTEST_RSP, AnySubType, srv.onDownLinkTestRsp)
+	return srv
+}
+
+func (srv *SuperiorServer) HandleFunc(t, subType uint16, h HandlerFunc) {
+	srv.mux.HandleFunc(t, subType, h)
+}
+
+func (srv *SuperiorServer) Handler(t, subType uint16) HandlerFunc {
+	return srv.mux.Handler(t, subType)
+}
+
+func (srv *SuperiorServer) Use(mws ...Middleware) {
+	srv.mux.Use(mws...)
+}
+
+// 当前已登录的下级平台，按接入码排序
+func (srv *SuperiorServer) Sessions() []*Session {
+	srv.mtx.Lock()
+	defer srv.mtx.Unlock()
+	ret := make([]*Session, 0, len(srv.sessions))
+	for _, s := range srv.sessions {
+		ret = append(ret, s)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].GNSSCenterID < ret[j].GNSSCenterID })
+	return ret
+}
+
+// 按接入码查询已登录的下级平台，没有登录时返回 nil
+func (srv *SuperiorServer) Session(gnssCenterID uint32) *Session {
+	srv.mtx.Lock()
+	defer srv.mtx.Unlock()
+	return srv.sessions[gnssCenterID]
+}
+
+// 监听主链路端口，直到 Shutdown 或者 ctx 结束时返回
+func (srv *SuperiorServer) Serve(ctx context.Context) error {
+	if srv.Authenticator == nil {
+		return ErrNoAuthenticator
+	}
+	ln, err := net.Listen("tcp", srv.Addr)
+	if err != nil {
+		return err
+	}
+	if srv.TLSConfig != nil {
+		ln = tls.NewListener(ln, srv.TLSConfig)
+	}
+
+	srv.mtx.Lock()
+	if srv.closing || srv.ln != nil {
+		srv.mtx.Unlock()
+		ln.Close()
+		return ErrServerClosed
+	}
+	srv.ln = ln
+	srv.d = newDispatcher(srv.DispatchMode, srv.DispatchWorkers, srv.DispatchQueueSize, srv.serve)
+	srv.mtx.Unlock()
+	level.Debug(srv.logger).Log("msg", "SuperiorServer start", "Addr", ln.Addr())
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			srv.Shutdown(ctx)
+		case <-srv.done:
+		}
+	}()
+
+	var tempDelay time.Duration
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			select {
+			case <-srv.done:
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				return nil
+			default:
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				if tempDelay == 0 {
+					tempDelay = 5 * time.Millisecond
+				} else {
+					tempDelay *= 2
+				}
+				if max := 1 * time.Second; tempDelay > max {
+					tempDelay = max
+				}
+				level.Debug(srv.logger).Log(
+					"msg", "SuperiorServer Accept temporary error",
+					"error", err,
+					"retrying", tempDelay)
+				time.Sleep(tempDelay)
+				continue
+			}
+			return err
+		}
+		tempDelay = 0
+
+		srv.wg.Add(1)
+		safego(func() { defer srv.wg.Done(); srv.serveConn(conn) }, srv.logger, "SuperiorServer serveConn panic")
+	}
+}
+
+// 停止监听，关闭所有下级平台的链路，等待处理中的数据包处理完成
+func (srv *SuperiorServer) Shutdown(ctx context.Context) error {
+	srv.mtx.Lock()
+	if srv.closing {
+		srv.mtx.Unlock()
+		return nil
+	}
+	srv.closing = true
+	close(srv.done)
+	if srv.ln != nil {
+		srv.ln.Close()
+	}
+	sessions := make([]*Session, 0, len(srv.sessions))
+	for _, s := range srv.sessions {
+		sessions = append(sessions, s)
+	}
+	d := srv.d
+	srv.mtx.Unlock()
+
+	for _, s := range sessions {
+		s.drain(ctx)
+		s.Close()
+	}
+
+	finished := make(chan struct{})
+	go func() {
+		srv.wg.Wait()
+		if d != nil {
+			d.close()
+		}
+		close(finished)
+	}()
+	select {
+	case <-finished:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (srv *SuperiorServer) serveConn(conn net.Conn) {
+	defer conn.Close()
+	dec := jt809.NewDecoder(conn, srv.codecOptions()...)
+
+	conn.SetReadDeadline(time.Now().Add(loginTimeout))
+	p, err := dec.Decode()
+	if err != nil {
+		level.Error(srv.logger).Log("msg", "SuperiorServer wait login", "remote", conn.RemoteAddr(), "error", err)
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+	req, ok := p.(*jt809.UpConnectReq)
+	if !ok {
+		level.Error(srv.logger).Log("msg", "SuperiorServer first packet should be UP_CONNECT_REQ", "remote", conn.RemoteAddr(), "packet", p)
+		return
+	}
+	level.Debug(srv.logger).Log("msg", "receive", "conn", "upconn", "packet", req)
+
+	gnssCenterID := req.Header().GNSSCenterID
+	// 使用下级平台登录请求中的版本号应答
+	version := req.Header().Version
+	result := jt809.UpConnectOther
+	if err := srv.Protocol.ValidVersion(version); err != nil {
+		level.Error(srv.logger).Log("msg", "SuperiorServer login", "remote", conn.RemoteAddr(), "GNSSCenterID", gnssCenterID, "error", err)
+		version = nil
+	} else {
+		result = srv.Authenticator.Authenticate(gnssCenterID, req, conn.RemoteAddr())
+	}
+
+	s := &Session{
+		GNSSCenterID: gnssCenterID,
+		UserID:       req.UserID,
+		VerifyCode:   randUint32(),
+		RemoteAddr:   conn.RemoteAddr(),
+		LoginAt:      time.Now(),
+		Version:      version,
+		srv:          srv,
+		encrypt:      srv.Encrypt,
+		upconn:       conn,
+		sngen:        jt809.NewSerialNoGenerater(),
+		done:         make(chan struct{}),
+	}
+	if srv.EncryptFor != nil {
+		s.encrypt = srv.EncryptFor(gnssCenterID)
+	}
+	s.upq = newSendQueue("upconn", conn, srv.SendQueueSize, srv.SendQueuePolicy, srv.logger, nil, s.codecOptions()...)
+	defer s.Close()
+
+	if result == jt809.UpConnectSuccess {
+		result = srv.addSession(s)
+		if result == jt809.UpConnectSuccess {
+			defer srv.removeSession(s)
+		}
+	}
+
+	rsp := jt809.NewUpConnectRsp()
+	rsp.Result = result
+	rsp.VerifyCode = s.VerifyCode
+	err = s.send(rsp)
+	if err != nil {
+		return
+	}
+	if result != jt809.UpConnectSuccess {
+		level.Info(srv.logger).Log("msg", "SuperiorServer login failed", "remote", conn.RemoteAddr(), "GNSSCenterID", gnssCenterID, "UserID", req.UserID, "Result", result)
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		s.upq.drain(ctx)
+		return
+	}
+	level.Info(srv.logger).Log("msg", "SuperiorServer login", "remote", conn.RemoteAddr(), "GNSSCenterID", gnssCenterID, "UserID", req.UserID)
+
+	ip := string(bytes.TrimRight(req.DownLinkIP, "\x00"))
+	addr := net.JoinHostPort(ip, fmt.Sprint(req.DownLinkPort))
+	srv.wg.Add(1)
+	safego(func() { defer srv.wg.Done(); s.serveDownLink(addr) }, srv.logger, "SuperiorServer downlink panic")
+
+	s.receive(dec, "upconn")
+}
+
+func (srv *SuperiorServer) codecOptions() []jt809.Option {
+	opts := append(srv.Encrypt.options(),
+		jt809.WithProtocol(srv.Protocol),
+		jt809.WithMaxFrameSize(srv.MaxFrameSize),
+		jt809.WithCRC16(srv.CRC16),
+		jt809.WithValidation(srv.Validation))
+	if srv.EncryptFor != nil {
+		opts = append(opts, jt809.WithCipherFunc(func(gnssCenterID uint32) jt809.Cipher {
+			return srv.EncryptFor(gnssCenterID).cipher()
+		}))
+	}
+	return opts
+}
+
+// 记录登录成功的 Session，返回登录应答的验证结果
+// 同一接入码已经登录时，按 RejectDuplicateLogin 拒绝登录或者关闭旧的 Session
+func (srv *SuperiorServer) addSession(s *Session) byte {
+	srv.mtx.Lock()
+	if srv.closing {
+		srv.mtx.Unlock()
+		return jt809.UpConnectOther
+	}
+	old := srv.sessions[s.GNSSCenterID]
+	if old != nil && srv.RejectDuplicateLogin {
+		srv.mtx.Unlock()
+		return jt809.UpConnectBusy
+	}
+	srv.sessions[s.GNSSCenterID] = s
+	srv.mtx.Unlock()
+
+	if old != nil {
+		level.Info(srv.logger).Log("msg", "SuperiorServer duplicate login, close old session", "session", old)
+		old.Close()
+	}
+	return jt809.UpConnectSuccess
+}
+
+func (srv *SuperiorServer) removeSession(s *Session) {
+	srv.mtx.Lock()
+	defer srv.mtx.Unlock()
+	if srv.sessions[s.GNSSCenterID] == s {
+		delete(srv.sessions, s.GNSSCenterID)
+	}
+}
+
+func (srv *SuperiorServer) serve(r received) {
+	defer func() {
+		if err := recover(); err != nil {
+			level.Error(srv.logger).Log(
+				"msg", "SuperiorServer handle panic",
+				"packet", r.packet,
+				"error", err,
+				"stack", debug.Stack())
+		}
+	}()
+
+	ctx := &Context{Context: context.Background(), Link: r.link, session: r.session}
+	srv.mux.ServePacket(ctx, r.packet)
+}
+
+func (srv *SuperiorServer) onUnsupport(ctx *Context, p jt809.Packet) {
+	level.Info(srv.logger).Log(
+		"msg", "SuperiorServer handle unsupport packet", "packet", p)
+}
+
+func (srv *SuperiorServer) onUpLinkTestReq(ctx *Context, p jt809.Packet) {
+	ctx.Reply(jt809.NewUpLinkTestRsp())
+}
+
+func (srv *SuperiorServer) onUpDisconnectReq(ctx *Context, p jt809.Packet) {
+	s := ctx.Session()
+	err := ctx.Reply(jt809.NewUpDisconnectRsp())
+	if err == nil {
+		c, cancel := context.WithTimeout(ctx, time.Second)
+		defer cancel()
+		s.drain(c)
+	}
+	level.Info(srv.logger).Log("msg", "SuperiorServer logout", "GNSSCenterID", s.GNSSCenterID)
+	s.Close()
+}
+
+func (srv *SuperiorServer) onDownConnectRsp(ctx *Context, p jt809.Packet) {
+	rsp := p.(*jt809.DownConnectRsp)
+	level.Info(srv.logger).Log("msg", "downlink connect response",
+		"GNSSCenterID", ctx.Session().GNSSCenterID, "Result", rsp.Result)
+}
+
+func (srv *SuperiorServer) onDownLinkTestRsp(ctx *Context, p jt809.Packet) {
+}
+
+// 一个已登录的下级平台，包含主链路和从链路
+type Session struct {
+	GNSSCenterID uint32
+	UserID       uint32
+	VerifyCode   uint32
+	RemoteAddr   net.Addr
+	LoginAt      time.Time
+	// 登录时协商的协议版本号
+	Version []byte
+
+	srv       *SuperiorServer
+	encrypt   EncryptConfig
+	received  uint64 // 收到的数据包数量，原子操作
+	dropped   uint64 // 因为接入码或者版本号不一致丢弃的数据包数量，原子操作
+	drops     dropCounter
+	mtx       sync.Mutex
+	upconn    net.Conn
+	downconn  net.Conn
+	upq       *sendQueue
+	downq     *sendQueue
+	sngen     *jt809.SerialNoGenerater
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// 收到的数据包数量和因为接入码或者版本号不一致丢弃的数据包数量
+func (s *Session) Counters() (received, dropped uint64) {
+	return atomic.LoadUint64(&s.received), atomic.LoadUint64(&s.dropped)
+}
+
+// 因为解码错误丢弃的帧和数据包数量
+func (s *Session) Drops() DropCounters {
+	return s.drops.load()
+}
+
+func (s *Session) String() string {
+	return fmt.Sprintf("Session{GNSSCenterID:%d, UserID:%d, RemoteAddr:%s}", s.GNSSCenterID, s.UserID, s.RemoteAddr)
+}
+
+// 向下级平台发送数据包，返回的错误可能是 ErrLinkUnavailable、ErrQueueFull、ErrQueueClosed 或者 *EncodeError
+func (s *Session) Send(p jt809.Packet) error {
+	return s.send(p)
+}
+
+func (s *Session) send(p jt809.Packet) error {
+	s.mtx.Lock()
+	q := selectQueue(p.LinkType(), s.upq, s.downq)
+	s.mtx.Unlock()
+	if q == nil {
+		return ErrLinkUnavailable
+	}
+
+	err := q.push(func(enc *jt809.Encoder, dst []byte) ([]byte, error) {
+		h := p.Header()
+		h.SerialNo = s.sngen.GetByType(h.Type)
+		h.GNSSCenterID = s.GNSSCenterID
+		setHeaderVersion(h, s.srv.Protocol, s.Version)
+		s.encrypt.setHeader(h)
+		b, err := enc.Append(dst, p)
+		if err != nil {
+			return b, &EncodeError{Packet: p, Err: err}
+		}
+		return b, nil
+	})
+	if err != nil {
+		level.Error(s.srv.logger).Log("msg", "Session send", "session", s, "conn", q.name, "packet", p, "error", err)
+		return err
+	}
+	level.Debug(s.srv.logger).Log("msg", "send", "session", s, "conn", q.name, "packet", p)
+	return nil
+}
+
+func (s *Session) codecOptions() []jt809.Option {
+	return append(s.encrypt.options(),
+		jt809.WithProtocol(s.srv.Protocol),
+		jt809.WithMaxFrameSize(s.srv.MaxFrameSize),
+		jt809.WithCRC16(s.srv.CRC16),
+		jt809.WithValidation(s.srv.Validation))
+}
+
+func (s *Session) drain(ctx context.Context) {
+	s.mtx.Lock()
+	upq, downq := s.upq, s.downq
+	s.mtx.Unlock()
+	for _, q := range []*sendQueue{upq, downq} {
+		if q != nil {
+			q.drain(ctx)
+		}
+	}
+}
+
+// 关闭主从链路
+func (s *Session) Close() {
+	s.closeOnce.Do(func() {
+		close(s.done)
+		s.mtx.Lock()
+		defer s.mtx.Unlock()
+		for _, q := range []*sendQueue{s.upq, s.downq} {
+			if q != nil {
+				q.close()
+			}
+		}
+		for _, conn := range []net.Conn{s.upconn, s.downconn} {
+			if conn != nil {
+				conn.Close()
+			}
+		}
+		s.upq, s.downq = nil, nil
+	})
+}
+
+func (s *Session) closed() bool {
+	select {
+	case <-s.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *Session) receive(dec *jt809.Decoder, connname string) {
+	for {
+		p, err := dec.Decode()
+		if de, ok := err.(*jt809.DecodeError); ok && de.Recoverable() {
+			ctx := &Context{Context: context.Background(), Link: connname, session: s}
+			drop(&s.drops, s.srv.OnDrop, ctx, de, s.srv.logger)
+			continue
+		}
+		if err != nil {
+			if !s.closed() {
+				level.Error(s.srv.logger).Log("msg", "Session receive Decode error", "session", s, "conn", connname, "error", err)
+			}
+			return
+		}
+		level.Debug(s.srv.logger).Log("msg", "receive", "session", s, "conn", connname, "packet", p)
+		// 每个数据包的接入码都要和登录的账号一致
+		if p.Header().GNSSCenterID != s.GNSSCenterID {
+			atomic.AddUint64(&s.dropped, 1)
+			level.Error(s.srv.logger).Log("msg", "Session GNSSCenterID mismatch, drop packet", "session", s, "conn", connname, "packet", p)
+			continue
+		}
+		if err := s.srv.Protocol.ValidVersion(p.Header().Version); err != nil {
+			atomic.AddUint64(&s.dropped, 1)
+			level.Error(s.srv.logger).Log("msg", "Session receive drop packet", "session", s, "conn", connname, "packet", p, "error", err)
+			continue
+		}
+		atomic.AddUint64(&s.received, 1)
+		s.srv.d.dispatch(received{link: connname, packet: p, session: s})
+	}
+}
+
+// 连接下级平台的从链路，连接失败或者断开后定时重连，直到 Session 关闭
+func (s *Session) serveDownLink(addr string) {
+	for {
+		conn, err := s.dialDownLink(addr)
+		if err != nil {
+			level.Error(s.srv.logger).Log("msg", "Session downlink Dial", "session", s, "addr", addr, "error", err)
+		} else {
+			s.runDownLink(conn)
+		}
+
+		select {
+		case <-s.done:
+			return
+		case <-time.After(downLinkRetryInterval):
+		}
+	}
+}
+
+func (s *Session) dialDownLink(addr string) (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", addr, downLinkRetryInterval)
+	if err != nil || s.srv.DownLinkTLSConfig == nil {
+		return conn, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), downLinkRetryInterval)
+	defer cancel()
+	host, _, _ := net.SplitHostPort(addr)
+	return tlsClient(ctx, conn, s.srv.DownLinkTLSConfig, host)
+}
+
+func (s *Session) runDownLink(conn net.Conn) {
+	s.mtx.Lock()
+	if s.closed() {
+		s.mtx.Unlock()
+		conn.Close()
+		return
+	}
+	s.downconn = conn
+	s.downq = newSendQueue("downconn", conn, s.srv.SendQueueSize, s.srv.SendQueuePolicy, s.srv.logger, nil, s.codecOptions()...)
+	s.mtx.Unlock()
+	defer func() {
+		s.mtx.Lock()
+		if s.downconn == conn {
+			if s.downq != nil {
+				s.downq.close()
+			}
+			s.downconn, s.downq = nil, nil
+		}
+		s.mtx.Unlock()
+		conn.Close()
+	}()
+
+	req := jt809.NewDownConnectReq()
+	req.VerifyCode = s.VerifyCode
+	if err := s.send(req); err != nil {
+		return
+	}
+	if s.srv.OnSession != nil {
+		safego(func() { s.srv.OnSession(s) }, s.srv.logger, "SuperiorServer OnSession panic")
+	}
+
+	linktestDone := make(chan struct{})
+	defer close(linktestDone)
+	safego(func() {
+		ticker := time.NewTicker(downLinkTestInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-linktestDone:
+				return
+			case <-ticker.C:
+				s.send(jt809.NewDownLinkTestReq())
+			}
+		}
+	}, s.srv.logger, "Session downlink linktest panic")
+
+	s.receive(jt809.NewDecoder(conn, s.codecOptions()...), "downconn")
+}
@@ -0,0 +1,161 @@
+package jt809server
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/lai323/jt809server/jt809"
+)
+
+func freePort(t *testing.T) uint16 {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return uint16(ln.Addr().(*net.TCPAddr).Port)
+}
+
+func TestSuperiorServer(t *testing.T) {
+	t.Run("plain", func(t *testing.T) {
+		testSuperiorServer(t, func(superior *SuperiorServer, srv *Server) {})
+	})
+	t.Run("encrypt", func(t *testing.T) {
+		testSuperiorServer(t, func(superior *SuperiorServer, srv *Server) {
+			encrypt := EncryptConfig{Enable: true, Params: jt809.EncryptParams{M1: 30000000, IA1: 20000000, IC1: 20000000}}
+			superior.Encrypt = encrypt
+			srv.Encrypt = encrypt
+		})
+	})
+	t.Run("2019", func(t *testing.T) {
+		testSuperiorServer(t, func(superior *SuperiorServer, srv *Server) {
+			superior.Protocol = jt809.Protocol2019
+			srv.Protocol = jt809.Protocol2019
+		})
+	})
+	t.Run("strict", func(t *testing.T) {
+		testSuperiorServer(t, func(superior *SuperiorServer, srv *Server) {
+			superior.Validation = jt809.ValidateStrict
+			srv.Validation = jt809.ValidateStrict
+		})
+	})
+	t.Run("tls", func(t *testing.T) {
+		serverConfig, clientConfig := testTLSConfig(t)
+		testSuperiorServer(t, func(superior *SuperiorServer, srv *Server) {
+			superior.TLSConfig = serverConfig
+			superior.DownLinkTLSConfig = clientConfig
+			srv.UpLinkTLSConfig = clientConfig
+			srv.DownLinkTLSConfig = serverConfig
+		})
+	})
+	t.Run("sm4", func(t *testing.T) {
+		c, err := jt809.NewSM4Cipher([]byte("0123456789abcdef"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		testSuperiorServer(t, func(superior *SuperiorServer, srv *Server) {
+			superior.EncryptFor = func(gnssCenterID uint32) EncryptConfig {
+				if gnssCenterID == 20180920 {
+					return EncryptConfig{Enable: true, Cipher: c}
+				}
+				return EncryptConfig{}
+			}
+			srv.Encrypt = EncryptConfig{Enable: true, Cipher: c}
+		})
+	})
+}
+
+func testSuperiorServer(t *testing.T, configure func(superior *SuperiorServer, srv *Server)) {
+	upPort, downPort := freePort(t), freePort(t)
+
+	superior := NewSuperiorServer(log.NewNopLogger())
+	superior.Addr = net.JoinHostPort("127.0.0.1", fmt.Sprint(upPort))
+	superior.Authenticator = AuthenticatorFunc(func(gnssCenterID uint32, req *jt809.UpConnectReq, remoteAddr net.Addr) byte {
+		if gnssCenterID != 20180920 || req.UserID != 1 {
+			return jt809.UpConnectUnregistered
+		}
+		if !bytes.Equal(req.Password, jt809.FixedLengthString("pass", 8, false)) {
+			return jt809.UpConnectPasswordError
+		}
+		return jt809.UpConnectSuccess
+	})
+	sessions := make(chan *Session, 1)
+	superior.OnSession = func(s *Session) { sessions <- s }
+	locations := make(chan *jt809.UpExgMsg, 1)
+	superior.HandleFunc(jt809.UP_EXG_MSG, jt809.UP_EXG_MSG_REAL_LOCATION, func(ctx *Context, p jt809.Packet) {
+		locations <- p.(*jt809.UpExgMsg)
+	})
+
+	srv := NewServer(log.NewNopLogger())
+	srv.UserID = 1
+	srv.Password = "pass"
+	srv.GNSSCenterID = 20180920
+	srv.UpLinkIP = "127.0.0.1"
+	srv.UpLinkPort = upPort
+	srv.DownLinkIP = "127.0.0.1"
+	srv.DownLinkPort = downPort
+	configure(superior, srv)
+	protocol := srv.Protocol
+
+	go superior.Serve(context.Background())
+	defer superior.Shutdown(context.Background())
+	time.Sleep(50 * time.Millisecond)
+	go srv.Serve(context.Background())
+
+	select {
+	case s := <-sessions:
+		if s.GNSSCenterID != 20180920 || s.UserID != 1 || !bytes.Equal(s.Version, protocol.Version()) {
+			t.Error("session error", s)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("wait session timeout")
+	}
+	for !srv.Status().LoggedIn {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	p := jt809.NewUpExgMsg()
+	p.VehicleNo = jt809.FixedLengthString("A12345", 21, true)
+	p.VehicleColor = jt809.PlateColorYellow
+	loc := jt809.NewUpExgMsgRealLocation()
+	loc.Date = make([]byte, 4)
+	loc.Time = make([]byte, 3)
+	loc.Lon = 116397128
+	p.SetSubPacket(loc)
+	if err := srv.UpRealLocation(p); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case got := <-locations:
+		if got.SubPacket().(*jt809.UpExgMsgRealLocation).Lon != 116397128 || (protocol == jt809.Protocol2019) != (got.Header().Time != 0) {
+			t.Error("location error", got)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("wait location timeout")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		t.Error("Shutdown error", err)
+	}
+	for len(superior.Sessions()) != 0 && ctx.Err() == nil {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(superior.Sessions()) != 0 {
+		t.Error("session should be removed after logout")
+	}
+}
+
+func TestSuperiorServerNoAuthenticator(t *testing.T) {
+	superior := NewSuperiorServer(log.NewNopLogger())
+	superior.Addr = "127.0.0.1:0"
+	if err := superior.Serve(context.Background()); err != ErrNoAuthenticator {
+		t.Error("Serve without Authenticator should return ErrNoAuthenticator", err)
+	}
+}
@@ -0,0 +1,37 @@
+package jt809server
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+)
+
+// 在已建立的连接上进行 TLS 握手，握手失败时关闭连接
+// config 没有设置 ServerName 时使用 host 验证对方证书
+func tlsClient(ctx context.Context, conn net.Conn, config *tls.Config, host string) (net.Conn, error) {
+	if config.ServerName == "" {
+		config = config.Clone()
+		config.ServerName = host
+	}
+	tlsconn := tls.Client(conn, config)
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	err := tlsconn.Handshake()
+	if err != nil {
+		conn.Close()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	return tlsconn, nil
+}